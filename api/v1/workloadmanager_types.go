@@ -25,14 +25,55 @@ type WorkloadTypes string
 const (
 	StatefulSet = "statefulset"
 	Deployment  = "deployment"
+	DaemonSet   = "daemonset"
+	CronJob     = "cronjob"
+	Job         = "job"
+	Custom      = "custom"
 )
 
+// RerunAnnotation forces the procedures to run again for the current generation when its
+// value differs from Status.LastRerun
+const RerunAnnotation = "k8smanagers.greyridge.com/rerun"
+
 type SPNLoginType string
 
+// Credentials of every login type are only held in memory, per target cluster, except for azCli
 const (
 	ListClusterAdminCredentials = "listClusterAdminCredentials"
-	AzCli                       = "azCli"
-	ListClusterUserCredentials  = "listClusterUserCredentials"
+
+	// ListClusterUserCredentials uses the user kubeconfig of the cluster. On clusters using Entra ID,
+	// requests carry tokens of the default Azure credential rather than running kubelogin.
+	ListClusterUserCredentials = "listClusterUserCredentials"
+
+	// AzCli logs in through the Azure CLI, which keeps its login on disk under ~/.azure. Opt in to it
+	// only when the other login types cannot be used.
+	AzCli = "azCli"
+
+	// InCluster moves workloads in the cluster the controller runs in, with its own service account
+	InCluster = "inCluster"
+
+	// KubeconfigSecret reaches the target cluster with the kubeconfig held in KubeconfigSecretRef
+	KubeconfigSecret = "kubeconfigSecret"
+
+	// AzureIdentity logs in to AKS natively with the identity set in AzureIdentity, without the Azure CLI
+	AzureIdentity = "azureIdentity"
+)
+
+// +kubebuilder:validation:Enum=workloadIdentity;managedIdentity;clientCertificate
+type AzureIdentityMethod string
+
+const (
+	WorkloadIdentity  AzureIdentityMethod = "workloadIdentity"
+	ManagedIdentity   AzureIdentityMethod = "managedIdentity"
+	ClientCertificate AzureIdentityMethod = "clientCertificate"
+)
+
+type MismatchPolicy string
+
+const (
+	MismatchWarn = "warn"
+	MismatchSkip = "skip"
+	MismatchFail = "fail"
 )
 
 type Affinity struct {
@@ -45,9 +86,78 @@ type Selector struct {
 	Key     string `json:"key,omitempty"`
 	Initial string `json:"initial,omitempty"`
 	Target  string `json:"target,omitempty"`
+
+	// Remove deletes Key from the node selector instead of setting it to Target
+	Remove bool `json:"remove,omitempty"`
+}
+
+// SecretKeyReference points at one key of a Secret
+type SecretKeyReference struct {
+	// Name of the Secret
+	Name string `json:"name"`
+
+	// Namespace of the Secret, defaults to the namespace of the WorkloadManager. Only the namespace
+	// of the WorkloadManager is allowed.
+	Namespace string `json:"namespace,omitempty"`
+
+	// Key in the Secret holding the value
+	// +kubebuilder:default="kubeconfig"
+	Key string `json:"key,omitempty"`
+}
+
+// SecretReference points at a Secret
+type SecretReference struct {
+	// Name of the Secret
+	Name string `json:"name"`
+
+	// Namespace of the Secret, defaults to the namespace of the WorkloadManager. Only the namespace
+	// of the WorkloadManager is allowed.
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// AzureIdentityConfig is the Microsoft Entra identity the controller logs in to AKS with
+type AzureIdentityConfig struct {
+	// Method used to get tokens for the identity
+	// +kubebuilder:default="workloadIdentity"
+	Method AzureIdentityMethod `json:"method,omitempty"`
+
+	// ClientID of the identity. Defaults to AZURE_CLIENT_ID, or the system-assigned identity
+	// for managedIdentity.
+	ClientID string `json:"clientId,omitempty"`
+
+	// TenantID of the identity. Defaults to AZURE_TENANT_ID.
+	TenantID string `json:"tenantId,omitempty"`
+
+	// CertificateSecretRef is a kubernetes.io/tls Secret holding the client certificate and its
+	// key, for the clientCertificate method. The Secret must be in the namespace of the WorkloadManager.
+	CertificateSecretRef *SecretReference `json:"certificateSecretRef,omitempty"`
+}
+
+// CustomWorkload identifies a workload kind outside the built-in types that embeds a pod template
+type CustomWorkload struct {
+	// APIVersion of the workload, for example argoproj.io/v1alpha1
+	APIVersion string `json:"apiVersion"`
+
+	// Kind of the workload, for example Rollout
+	Kind string `json:"kind"`
+
+	// PodTemplatePath is the dot separated path to the pod template of the workload
+	// +kubebuilder:default="spec.template"
+	PodTemplatePath string `json:"podTemplatePath,omitempty"`
 }
 
 type Procedure struct {
+	// Name identifies the procedure in DependsOn
+	Name string `json:"name,omitempty"`
+
+	// DependsOn lists the procedures that must succeed, or be skipped, before this one starts. When
+	// one of them fails or times out this procedure fails without being started, and so do the
+	// procedures depending on it in turn; procedures that do not depend on it run on. When no
+	// procedure sets DependsOn they run in list order, each depending on the one before it under
+	// the same rule. As soon as any procedure sets it, list order is ignored and every procedure
+	// without DependsOn starts straight away, in parallel.
+	DependsOn []string `json:"dependsOn,omitempty"`
+
 	Description string        `json:"description,omitempty"`
 	Type        WorkloadTypes `json:"type,omitempty"`
 	Namespace   string        `json:"namespace,omitempty"`
@@ -55,6 +165,39 @@ type Procedure struct {
 	Affinity    Affinity      `json:"affinity,omitempty"`
 	Selector    Selector      `json:"selector,omitempty"`
 	Timeout     int           `json:"timeout,omitempty"`
+
+	// WorkloadSelector adds the workloads matching the labels to Workloads when the procedure runs.
+	// An empty Namespace searches the whole cluster.
+	WorkloadSelector *metav1.LabelSelector `json:"workloadSelector,omitempty"`
+
+	// NamespaceSelector searches the matching namespaces for WorkloadSelector instead of Namespace.
+	// It needs WorkloadSelector or DiscoverByInitial, Workloads are only looked up in Namespace.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// DiscoverByInitial adds every workload of Type on the Initial affinity or selector to Workloads.
+	// An empty Namespace searches the whole cluster.
+	DiscoverByInitial bool `json:"discoverByInitial,omitempty"`
+
+	// Custom describes the workload kind when Type is custom
+	Custom *CustomWorkload `json:"custom,omitempty"`
+
+	// OnMismatch decides what happens to a workload that is not on the Initial affinity or selector
+	// +kubebuilder:validation:Enum=warn;skip;fail
+	// +kubebuilder:default=warn
+	OnMismatch MismatchPolicy `json:"onMismatch,omitempty"`
+
+	// ForceConflicts takes ownership of the scheduling fields when they are managed by another field
+	// manager, such as kubectl, helm or a CI pipeline. By default those workloads are left alone and
+	// the WorkloadManager fails with the FieldConflict reason; set it to true to take them over.
+	// +kubebuilder:default=false
+	ForceConflicts *bool `json:"forceConflicts,omitempty"`
+
+	// MaxConcurrent is how many workloads of the procedure are moved at once, overriding Spec.MaxConcurrent
+	// +kubebuilder:validation:Minimum=1
+	MaxConcurrent int `json:"maxConcurrent,omitempty"`
+
+	// RollbackOnFailure restores a workload to the Initial affinity and selector when it is not ready within Timeout
+	RollbackOnFailure bool `json:"rollbackOnFailure,omitempty"`
 }
 
 // WorkloadManagerSpec defines the desired state of WorkloadManager
@@ -66,16 +209,98 @@ type WorkloadManagerSpec struct {
 	RetryOnError   bool        `json:"retryOnError,omitempty"`
 	TestMode       bool        `json:"testMode,omitempty"`
 	Procedures     []Procedure `json:"procedures,omitempty"`
+
+	// MaxConcurrent is how many workloads of each procedure are moved at once. Defaults to one.
+	// +kubebuilder:validation:Minimum=1
+	MaxConcurrent int `json:"maxConcurrent,omitempty"`
+
+	// KubeconfigSecretRef holds the kubeconfig of the target cluster for the kubeconfigSecret login type.
+	// The Secret must be in the namespace of the WorkloadManager. The kubeconfig is only kept in memory
+	// and is loaded again from the next step on when the Secret changes.
+	KubeconfigSecretRef *SecretKeyReference `json:"kubeconfigSecretRef,omitempty"`
+
+	// AzureIdentity is the identity used by the azureIdentity login type. Tokens are requested and
+	// refreshed in memory by the controller.
+	AzureIdentity *AzureIdentityConfig `json:"azureIdentity,omitempty"`
+}
+
+// +kubebuilder:validation:Enum=Pending;Validating;Applying;WaitingReady;Succeeded;Skipped;RollingBack;RolledBack;Failed;TimedOut
+type ProcedurePhase string
+
+const (
+	PhasePending      ProcedurePhase = "Pending"
+	PhaseValidating   ProcedurePhase = "Validating"
+	PhaseApplying     ProcedurePhase = "Applying"
+	PhaseWaitingReady ProcedurePhase = "WaitingReady"
+	PhaseSucceeded    ProcedurePhase = "Succeeded"
+	PhaseSkipped      ProcedurePhase = "Skipped"
+	PhaseRollingBack  ProcedurePhase = "RollingBack"
+	PhaseRolledBack   ProcedurePhase = "RolledBack"
+	PhaseFailed       ProcedurePhase = "Failed"
+	PhaseTimedOut     ProcedurePhase = "TimedOut"
+)
+
+// Condition types reported on the WorkloadManager
+const (
+	ConditionReady       = "Ready"
+	ConditionValidated   = "Validated"
+	ConditionProgressing = "Progressing"
+	ConditionDegraded    = "Degraded"
+)
+
+// WorkloadStatus records the progress of a single workload within a procedure
+type WorkloadStatus struct {
+	Name      string         `json:"name"`
+	Namespace string         `json:"namespace,omitempty"`
+	Phase     ProcedurePhase `json:"phase,omitempty"`
+	StartTime *metav1.Time   `json:"startTime,omitempty"`
+	EndTime   *metav1.Time   `json:"endTime,omitempty"`
+	NodePool  string         `json:"nodePool,omitempty"`
+	LastError string         `json:"lastError,omitempty"`
+
+	// Message notes what the run found about the workload that did not stop it, such as a
+	// mismatch with the Initial node pool under the warn policy
+	Message string `json:"message,omitempty"`
+
+	// RollbackTime is when the workload was sent back to its Initial node pool
+	RollbackTime *metav1.Time `json:"rollbackTime,omitempty"`
+}
+
+// ProcedureStatus records the progress of the procedure at the same index in Spec.Procedures
+type ProcedureStatus struct {
+	Name        string           `json:"name,omitempty"`
+	Description string           `json:"description,omitempty"`
+	Type        WorkloadTypes    `json:"type,omitempty"`
+	Namespace   string           `json:"namespace,omitempty"`
+	Phase       ProcedurePhase   `json:"phase,omitempty"`
+	Workloads   []WorkloadStatus `json:"workloads,omitempty"`
+
+	// Message explains why the procedure has not started
+	Message string `json:"message,omitempty"`
 }
 
 // WorkloadManagerStatus defines the observed state of WorkloadManager
 type WorkloadManagerStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	Phase               ProcedurePhase    `json:"phase,omitempty"`
+	CurrentProcedure    string            `json:"currentProcedure,omitempty"`
+	ObservedGeneration  int64             `json:"observedGeneration,omitempty"`
+	CompletedGeneration int64             `json:"completedGeneration,omitempty"`
+	LastRerun           string            `json:"lastRerun,omitempty"`
+	Procedures          []ProcedureStatus `json:"procedures,omitempty"`
+
+	// ObservedRerun is the re-run annotation the run in progress was started for
+	ObservedRerun string `json:"observedRerun,omitempty"`
+
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Procedure",type=string,JSONPath=`.status.currentProcedure`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // WorkloadManager is the Schema for the workloadmanagers API
 type WorkloadManager struct {
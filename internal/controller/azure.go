@@ -0,0 +1,200 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerservice/armcontainerservice"
+	"golang.org/x/oauth2"
+	k8smanagersv1 "greyridge.com/workloadManager/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/transport"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"time"
+)
+
+// aksTokenScope is the scope of the tokens accepted by the AKS managed Microsoft Entra integration
+const aksTokenScope = "6dae42f8-4368-4678-94ff-3960e28e3630/.default"
+
+// tokenRequestTimeout bounds a token request made on behalf of a call to the target cluster
+const tokenRequestTimeout = 30 * time.Second
+
+// azureIdentityOf returns the identity of the WorkloadManager, defaulting to workload identity
+func azureIdentityOf(wlManager *k8smanagersv1.WorkloadManager) k8smanagersv1.AzureIdentityConfig {
+	identity := k8smanagersv1.AzureIdentityConfig{}
+	if wlManager.Spec.AzureIdentity != nil {
+		identity = *wlManager.Spec.AzureIdentity
+	}
+	if identity.Method == "" {
+		identity.Method = k8smanagersv1.WorkloadIdentity
+	}
+	return identity
+}
+
+// certificateSecretName returns the namespace and name of the client certificate Secret of the WorkloadManager
+func certificateSecretName(wlManager *k8smanagersv1.WorkloadManager) types.NamespacedName {
+	identity := azureIdentityOf(wlManager)
+	if identity.Method != k8smanagersv1.ClientCertificate || identity.CertificateSecretRef == nil {
+		return types.NamespacedName{}
+	}
+
+	namespace := identity.CertificateSecretRef.Namespace
+	if namespace == "" {
+		namespace = wlManager.Namespace
+	}
+	return types.NamespacedName{Namespace: namespace, Name: identity.CertificateSecretRef.Name}
+}
+
+// getCertificateSecret fetches the client certificate Secret of the WorkloadManager
+func (r *WorkloadManagerReconciler) getCertificateSecret(ctx context.Context, wlManager *k8smanagersv1.WorkloadManager) (*corev1.Secret, error) {
+	name := certificateSecretName(wlManager)
+	if name.Name == "" {
+		return nil, fmt.Errorf("azureIdentity.certificateSecretRef is mandatory when using %s", k8smanagersv1.ClientCertificate)
+	}
+	if err := checkSecretNamespace(wlManager, "azureIdentity.certificateSecretRef", wlManager.Spec.AzureIdentity.CertificateSecretRef.Namespace); err != nil {
+		return nil, err
+	}
+
+	secret := &corev1.Secret{}
+	if err := r.reader().Get(ctx, name, secret); err != nil {
+		return nil, fmt.Errorf("reading certificate Secret %s: %w", name, err)
+	}
+	if len(secret.Data[corev1.TLSCertKey]) == 0 || len(secret.Data[corev1.TLSPrivateKeyKey]) == 0 {
+		return nil, fmt.Errorf("certificate Secret %s needs %s and %s", name, corev1.TLSCertKey, corev1.TLSPrivateKeyKey)
+	}
+	return secret, nil
+}
+
+// azureCredential builds the credential for the identity of the WorkloadManager. Environment
+// variables set by the workload identity webhook fill in what the spec leaves out.
+func (r *WorkloadManagerReconciler) azureCredential(ctx context.Context, wlManager *k8smanagersv1.WorkloadManager) (azcore.TokenCredential, error) {
+	identity := azureIdentityOf(wlManager)
+
+	if identity.Method == k8smanagersv1.WorkloadIdentity {
+		return azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{
+			ClientID: identity.ClientID,
+			TenantID: identity.TenantID,
+		})
+	}
+
+	if identity.Method == k8smanagersv1.ManagedIdentity {
+		options := &azidentity.ManagedIdentityCredentialOptions{}
+		if identity.ClientID != "" {
+			options.ID = azidentity.ClientID(identity.ClientID)
+		}
+		return azidentity.NewManagedIdentityCredential(options)
+	}
+
+	if identity.Method == k8smanagersv1.ClientCertificate {
+		if identity.ClientID == "" || identity.TenantID == "" {
+			return nil, errors.New("azureIdentity.clientId and azureIdentity.tenantId are mandatory when using " + string(k8smanagersv1.ClientCertificate))
+		}
+
+		secret, err := r.getCertificateSecret(ctx, wlManager)
+		if err != nil {
+			return nil, err
+		}
+
+		pemData := append(append([]byte{}, secret.Data[corev1.TLSCertKey]...), '\n')
+		pemData = append(pemData, secret.Data[corev1.TLSPrivateKeyKey]...)
+		certs, key, err := azidentity.ParseCertificates(pemData, nil)
+		if err != nil {
+			return nil, fmt.Errorf("parsing certificate Secret %s: %w", certificateSecretName(wlManager), err)
+		}
+
+		return azidentity.NewClientCertificateCredential(identity.TenantID, identity.ClientID, certs, key, nil)
+	}
+
+	return nil, fmt.Errorf("unsupported azureIdentity method %q", identity.Method)
+}
+
+// azureIdentityConfig logs in to the AKS cluster of the WorkloadManager with its Azure identity.
+// The user kubeconfig only provides the server and its CA; requests carry an Entra token for the
+// identity, refreshed before it expires. Nothing is written to disk.
+func (r *WorkloadManagerReconciler) azureIdentityConfig(ctx context.Context, wlManager *k8smanagersv1.WorkloadManager) (*rest.Config, error) {
+	l := log.Log
+
+	if wlManager.Spec.SubscriptionID == "" || wlManager.Spec.ResourceGroup == "" || wlManager.Spec.ClusterName == "" {
+		return nil, errors.New("subscriptionId, resourceGroup and clusterName are mandatory when using " + k8smanagersv1.AzureIdentity)
+	}
+
+	cred, err := r.azureCredential(ctx, wlManager)
+	if err != nil {
+		l.Error(err, "Cannot build Azure credential")
+		return nil, err
+	}
+
+	aksClient, err := armcontainerservice.NewManagedClustersClient(wlManager.Spec.SubscriptionID, cred, nil)
+	if err != nil {
+		l.Error(err, "Cannot create AKS client")
+		return nil, err
+	}
+
+	resp, err := aksClient.ListClusterUserCredentials(ctx, wlManager.Spec.ResourceGroup, wlManager.Spec.ClusterName, nil)
+	if err != nil {
+		l.Error(err, "failed to get AKS credentials using "+k8smanagersv1.AzureIdentity)
+		return nil, err
+	}
+	if len(resp.Kubeconfigs) == 0 || resp.Kubeconfigs[0] == nil {
+		return nil, errors.New("Login has failed using " + k8smanagersv1.AzureIdentity)
+	}
+
+	return tokenConfig(resp.Kubeconfigs[0].Value, cred)
+}
+
+// tokenConfig builds the config for the cluster of the kubeconfig. A cluster using local accounts
+// is reached with the credentials of the kubeconfig, and a cluster using Entra ID with tokens from cred.
+func tokenConfig(kubeconfig []byte, cred azcore.TokenCredential) (*rest.Config, error) {
+	apiConfig, err := clientcmd.Load(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	kubeContext := apiConfig.Contexts[apiConfig.CurrentContext]
+	if kubeContext == nil {
+		return nil, fmt.Errorf("kubeconfig has no context %q", apiConfig.CurrentContext)
+	}
+	cluster := apiConfig.Clusters[kubeContext.Cluster]
+	if cluster == nil {
+		return nil, fmt.Errorf("kubeconfig has no cluster %q", kubeContext.Cluster)
+	}
+
+	authInfo := apiConfig.AuthInfos[kubeContext.AuthInfo]
+	if authInfo != nil && authInfo.Exec == nil && authInfo.AuthProvider == nil {
+		return clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+	}
+
+	config := &rest.Config{
+		Host: cluster.Server,
+		TLSClientConfig: rest.TLSClientConfig{
+			CAData:     cluster.CertificateAuthorityData,
+			ServerName: cluster.TLSServerName,
+		},
+	}
+	source := oauth2.ReuseTokenSourceWithExpiry(nil, azureTokenSource{cred: cred}, credentialRefreshMargin)
+	config.Wrap(transport.TokenSourceWrapTransport(source))
+	return config, nil
+}
+
+// azureTokenSource requests Entra tokens for the AKS server
+type azureTokenSource struct {
+	cred azcore.TokenCredential
+}
+
+func (s azureTokenSource) Token() (*oauth2.Token, error) {
+	// Tokens are requested from the transport, outside of any reconcile
+	ctx, cancel := context.WithTimeout(context.Background(), tokenRequestTimeout)
+	defer cancel()
+
+	token, err := s.cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{aksTokenScope}})
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{AccessToken: token.Token, TokenType: "Bearer", Expiry: token.ExpiresOn}, nil
+}
@@ -0,0 +1,279 @@
+package controller
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	k8smanagersv1 "greyridge.com/workloadManager/api/v1"
+	"greyridge.com/workloadManager/internal/controller/monitoring"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"strings"
+	"time"
+)
+
+// credentialTTL is how long the clients of a target cluster are used before logging in again when
+// the credentials do not say when they expire
+const credentialTTL = time.Hour
+
+// credentialRefreshMargin is how long before the credentials expire that they are refreshed
+const credentialRefreshMargin = 5 * time.Minute
+
+// loginTimeout bounds a login to a target cluster, which outlives the reconcile that started it
+const loginTimeout = 2 * time.Minute
+
+// clusterKey identifies the cluster a WorkloadManager targets and how the controller logs in to it
+type clusterKey struct {
+	SubscriptionID string
+	ResourceGroup  string
+	ClusterName    string
+	SPNLoginType   string
+
+	// KubeconfigSecret is the namespace and name of the kubeconfig Secret, for that login type
+	KubeconfigSecret string
+
+	// AzureIdentity is the method, client, tenant and certificate Secret of the identity, for that login type
+	AzureIdentity string
+}
+
+// targetCluster holds the clients for one target cluster, shared by every WorkloadManager moving
+// workloads on it
+type targetCluster struct {
+	clientset     kubernetes.Interface
+	dynamicClient dynamic.Interface
+	restMapper    meta.RESTMapper
+
+	// watcher is only set when running under the manager, otherwise workloads are polled
+	watcher *workloadWatcher
+
+	expiresAt time.Time
+	// version of the credentials the clients were built with, see credentialVersion
+	version string
+	owners  map[types.NamespacedName]struct{}
+}
+
+// Helper function to get the cluster key of the WorkloadManager
+func clusterKeyOf(wlManager *k8smanagersv1.WorkloadManager) clusterKey {
+	key := clusterKey{
+		SubscriptionID: wlManager.Spec.SubscriptionID,
+		ResourceGroup:  wlManager.Spec.ResourceGroup,
+		ClusterName:    wlManager.Spec.ClusterName,
+		SPNLoginType:   wlManager.Spec.SPNLoginType,
+	}
+	if wlManager.Spec.SPNLoginType == k8smanagersv1.KubeconfigSecret {
+		key.KubeconfigSecret = kubeconfigSecretName(wlManager).String()
+	}
+	if wlManager.Spec.SPNLoginType == k8smanagersv1.AzureIdentity {
+		identity := azureIdentityOf(wlManager)
+		key.AzureIdentity = strings.Join([]string{string(identity.Method), identity.ClientID, identity.TenantID,
+			certificateSecretName(wlManager).String()}, "/")
+	}
+	return key
+}
+
+// targetCluster returns the clients for the cluster the WorkloadManager targets. The clients are
+// cached per cluster and built again once their credentials are about to expire or have changed.
+// Logging in can take a while, so it is done outside of clustersMu: a single login runs per cluster
+// and credentials, and the WorkloadManagers waiting on it share its clients.
+func (r *WorkloadManagerReconciler) targetCluster(ctx context.Context, wlManager *k8smanagersv1.WorkloadManager) (*targetCluster, error) {
+	l := log.Log
+
+	key := clusterKeyOf(wlManager)
+	owner := types.NamespacedName{Namespace: wlManager.Namespace, Name: wlManager.Name}
+
+	version, err := r.credentialVersion(ctx, wlManager)
+	if err != nil {
+		return nil, err
+	}
+
+	r.clustersMu.Lock()
+	// The WorkloadManager may have been pointed at another cluster since it was last reconciled
+	r.releaseClusterLocked(owner, key)
+
+	if cluster, ok := r.clusters[key]; ok && cluster.usable(version) {
+		l.V(1).Info("Returning cached clients", "cluster", key.ClusterName)
+		cluster.owners[owner] = struct{}{}
+		r.clustersMu.Unlock()
+		return cluster, nil
+	}
+	r.clustersMu.Unlock()
+
+	result, err, _ := r.logins.Do(fmt.Sprintf("%v/%s", key, version), func() (interface{}, error) {
+		// The login is shared with the WorkloadManagers waiting on it, the one that started it being
+		// cancelled must not fail theirs
+		loginCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), loginTimeout)
+		defer cancel()
+
+		l.Info("Logging in to target cluster", "cluster", key.ClusterName)
+		config, err := r.getClientSet(loginCtx, wlManager)
+		if err != nil {
+			return nil, err
+		}
+
+		cluster, err := r.newTargetCluster(config)
+		if err != nil {
+			return nil, err
+		}
+		cluster.version = version
+		return cluster, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	cluster := result.(*targetCluster)
+
+	r.clustersMu.Lock()
+	defer r.clustersMu.Unlock()
+
+	if current, ok := r.clusters[key]; ok && current != cluster {
+		if current.usable(version) {
+			// Another login for the cluster finished first
+			current.owners[owner] = struct{}{}
+			return current, nil
+		}
+		l.Info("Credentials expired or changed, replacing clients", "cluster", key.ClusterName)
+		// The other WorkloadManagers on the cluster carry on with the new clients
+		for other := range current.owners {
+			cluster.owners[other] = struct{}{}
+		}
+		if current.watcher != nil && cluster.watcher != nil {
+			cluster.watcher.adopt(current.watcher)
+		}
+		r.dropClusterLocked(key)
+	}
+
+	if r.clusters == nil {
+		r.clusters = map[clusterKey]*targetCluster{}
+	}
+	if _, ok := r.clusters[key]; !ok {
+		r.clusters[key] = cluster
+		l.Info("Connected to target cluster", "cluster", key.ClusterName, "expires", cluster.expiresAt)
+	}
+	cluster.owners[owner] = struct{}{}
+
+	return cluster, nil
+}
+
+// usable checks that the clients have not expired and were built with the credentials of version
+func (c *targetCluster) usable(version string) bool {
+	return time.Now().Before(c.expiresAt) && c.version == version
+}
+
+// newTargetCluster builds the clients for the cluster reached through config
+func (r *WorkloadManagerReconciler) newTargetCluster(config *rest.Config) (*targetCluster, error) {
+	l := log.Log
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		l.Error(err, "Cannot GetClientSet")
+		return nil, err
+	}
+
+	// The dynamic client reaches custom workload kinds
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		l.Error(err, "Cannot create dynamic client")
+		return nil, err
+	}
+
+	cluster := &targetCluster{
+		clientset:     clientset,
+		dynamicClient: dynamicClient,
+		restMapper:    restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(clientset.Discovery())),
+		expiresAt:     credentialExpiry(config),
+		owners:        map[types.NamespacedName]struct{}{},
+	}
+
+	// Workloads being moved are watched when running under the manager, otherwise they are polled
+	if r.events != nil {
+		cluster.watcher = newWorkloadWatcher(clientset, r.events)
+	}
+
+	return cluster, nil
+}
+
+// releaseCluster drops the WorkloadManager from every cluster it used, and the clients of the
+// clusters no other WorkloadManager uses. The Secrets it logs in with are no longer watched.
+func (r *WorkloadManagerReconciler) releaseCluster(owner types.NamespacedName) {
+	if r.secrets != nil {
+		r.secrets.release(owner)
+	}
+
+	r.clustersMu.Lock()
+	defer r.clustersMu.Unlock()
+
+	r.releaseClusterLocked(owner, clusterKey{})
+}
+
+// Helper function to release the WorkloadManager from every cluster but keep, with clustersMu held
+func (r *WorkloadManagerReconciler) releaseClusterLocked(owner types.NamespacedName, keep clusterKey) {
+	for key, cluster := range r.clusters {
+		if key == keep {
+			continue
+		}
+		if _, ok := cluster.owners[owner]; !ok {
+			continue
+		}
+
+		delete(cluster.owners, owner)
+		if cluster.watcher != nil {
+			cluster.watcher.release(owner)
+		}
+		if len(cluster.owners) == 0 {
+			log.Log.Info("Dropping clients of unused target cluster", "cluster", key.ClusterName)
+			r.dropClusterLocked(key)
+		}
+	}
+}
+
+// Helper function to stop and forget the clients of a cluster, with clustersMu held
+func (r *WorkloadManagerReconciler) dropClusterLocked(key clusterKey) {
+	if cluster := r.clusters[key]; cluster != nil && cluster.watcher != nil {
+		cluster.watcher.stop()
+	}
+	delete(r.clusters, key)
+}
+
+// watch follows the workloads of the WorkloadManager that are still being moved
+func (c *targetCluster) watch(wlManager *k8smanagersv1.WorkloadManager) {
+	if c.watcher != nil {
+		c.watcher.setWatched(wlManager)
+	}
+}
+
+// watchWorkload starts following a workload being waited on, read from the API server as resource
+func (c *targetCluster) watchWorkload(resource interface{}, wlType string) {
+	if c.watcher != nil && wlType != k8smanagersv1.Custom {
+		c.watcher.watchWorkload(resource, wlType)
+	}
+}
+
+// reader returns the reader of a followed workload once its informers have synced, nil when the
+// workload is to be read from the API server
+func (c *targetCluster) reader(wlType string, namespace string, name string) monitoring.Reader {
+	if c.watcher == nil || wlType == k8smanagersv1.Custom {
+		return nil
+	}
+	return c.watcher.reader(wlType, namespace, name)
+}
+
+// credentialExpiry returns when the clients built from config should be replaced: shortly before
+// the client certificate expires, or after credentialTTL for other credentials
+func credentialExpiry(config *rest.Config) time.Time {
+	block, _ := pem.Decode(config.TLSClientConfig.CertData)
+	if block == nil {
+		return time.Now().Add(credentialTTL)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Now().Add(credentialTTL)
+	}
+	return cert.NotAfter.Add(-credentialRefreshMargin)
+}
@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	k8smanagersv1 "greyridge.com/workloadManager/api/v1"
+	"greyridge.com/workloadManager/internal/controller/scheduling"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+// customResource returns the dynamic client for the custom workload kind of the procedure
+func (r *WorkloadManagerReconciler) customResource(cluster *targetCluster, procedure k8smanagersv1.Procedure) (dynamic.ResourceInterface, error) {
+	if procedure.Custom == nil {
+		return nil, errors.New("custom workload kind is not set")
+	}
+	if cluster.dynamicClient == nil || cluster.restMapper == nil {
+		return nil, errors.New("dynamic client is not available")
+	}
+
+	gvk := schema.FromAPIVersionAndKind(procedure.Custom.APIVersion, procedure.Custom.Kind)
+	mapping, err := cluster.restMapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
+		return cluster.dynamicClient.Resource(mapping.Resource), nil
+	}
+	return cluster.dynamicClient.Resource(mapping.Resource).Namespace(procedure.Namespace), nil
+}
+
+// getCustomWorkload fetches the named workload of the procedure's custom kind
+func (r *WorkloadManagerReconciler) getCustomWorkload(ctx context.Context, cluster *targetCluster, procedure k8smanagersv1.Procedure, name string) (interface{}, error) {
+	resourceClient, err := r.customResource(cluster, procedure)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := resourceClient.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return scheduling.NewUnstructuredWorkload(obj, procedure.Custom.PodTemplatePath), nil
+}
+
+// patchCustomWorkload sends the patch to the named workload of the procedure's custom kind
+func (r *WorkloadManagerReconciler) patchCustomWorkload(ctx context.Context, cluster *targetCluster, procedure k8smanagersv1.Procedure, name string, patchType types.PatchType, data []byte, opts metav1.PatchOptions) (interface{}, error) {
+	resourceClient, err := r.customResource(cluster, procedure)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := resourceClient.Patch(ctx, name, patchType, data, opts)
+	if err != nil {
+		return nil, err
+	}
+	return scheduling.NewUnstructuredWorkload(obj, procedure.Custom.PodTemplatePath), nil
+}
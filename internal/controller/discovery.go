@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	k8smanagersv1 "greyridge.com/workloadManager/api/v1"
+	"greyridge.com/workloadManager/internal/controller/scheduling"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sort"
+)
+
+// resolveWorkloads adds the workloads matching the procedure's WorkloadSelector, and those on its
+// Initial affinity or selector when DiscoverByInitial is set, to its status. Workloads named in the
+// spec keep their place at the front, the matches follow sorted by namespace and name so that every
+// run moves them in the same order.
+func (r *WorkloadManagerReconciler) resolveWorkloads(ctx context.Context, cluster *targetCluster, wlManager *k8smanagersv1.WorkloadManager, index int, wlType string) error {
+	l := log.Log
+
+	procedure := wlManager.Spec.Procedures[index]
+	if procedure.WorkloadSelector == nil && !procedure.DiscoverByInitial {
+		// Workloads named in the spec are only looked up in Namespace, the selector would be ignored
+		if procedure.NamespaceSelector != nil {
+			return errors.New("namespaceSelector needs workloadSelector or discoverByInitial, workloads are only looked up in namespace")
+		}
+		return nil
+	}
+
+	selector := labels.Everything()
+	if procedure.WorkloadSelector != nil {
+		var err error
+		selector, err = metav1.LabelSelectorAsSelector(procedure.WorkloadSelector)
+		if err != nil {
+			return fmt.Errorf("invalid workloadSelector: %w", err)
+		}
+	}
+
+	namespaces := []string{procedure.Namespace}
+	if procedure.NamespaceSelector != nil {
+		var err error
+		namespaces, err = listNamespaces(ctx, cluster.clientset, procedure.NamespaceSelector)
+		if err != nil {
+			return err
+		}
+	}
+
+	var refs []types.NamespacedName
+	for _, namespace := range namespaces {
+		resources, err := r.listWorkloads(ctx, cluster, procedure, wlType, namespace, selector.String())
+		if err != nil {
+			return fmt.Errorf("listing %s in namespace %q: %w", wlType, namespace, err)
+		}
+		for _, resource := range resources {
+			if procedure.DiscoverByInitial && !scheduling.IsOnInitial(resource, procedure) {
+				continue
+			}
+			object := resource.(metav1.Object)
+			refs = append(refs, types.NamespacedName{Namespace: object.GetNamespace(), Name: object.GetName()})
+		}
+	}
+
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Namespace != refs[j].Namespace {
+			return refs[i].Namespace < refs[j].Namespace
+		}
+		return refs[i].Name < refs[j].Name
+	})
+
+	for _, ref := range refs {
+		workloadStatus(wlManager, index, ref.Namespace, ref.Name)
+	}
+
+	l.Info("Resolved workloads", "procedure", procedureName(procedure, index), "selector", selector.String(),
+		"discoverByInitial", procedure.DiscoverByInitial, "matches", len(refs))
+	return nil
+}
+
+// listNamespaces returns the sorted names of the namespaces matching the label selector
+func listNamespaces(ctx context.Context, clientset kubernetes.Interface, labelSelector *metav1.LabelSelector) ([]string, error) {
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid namespaceSelector: %w", err)
+	}
+
+	list, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces := make([]string, 0, len(list.Items))
+	for _, namespace := range list.Items {
+		namespaces = append(namespaces, namespace.Name)
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// listWorkloads returns the workloads of the given type in namespace matching the label selector.
+// An empty namespace lists the whole cluster.
+func (r *WorkloadManagerReconciler) listWorkloads(ctx context.Context, cluster *targetCluster, procedure k8smanagersv1.Procedure, wlType string, namespace string, selector string) ([]interface{}, error) {
+	opts := metav1.ListOptions{LabelSelector: selector}
+
+	var items []interface{}
+
+	if wlType == k8smanagersv1.StatefulSet {
+		list, err := cluster.clientset.AppsV1().StatefulSets(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			items = append(items, &list.Items[i])
+		}
+	} else if wlType == k8smanagersv1.Deployment {
+		list, err := cluster.clientset.AppsV1().Deployments(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			items = append(items, &list.Items[i])
+		}
+	} else if wlType == k8smanagersv1.DaemonSet {
+		list, err := cluster.clientset.AppsV1().DaemonSets(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			items = append(items, &list.Items[i])
+		}
+	} else if wlType == k8smanagersv1.CronJob {
+		list, err := cluster.clientset.BatchV1().CronJobs(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			items = append(items, &list.Items[i])
+		}
+	} else if wlType == k8smanagersv1.Job {
+		list, err := cluster.clientset.BatchV1().Jobs(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			items = append(items, &list.Items[i])
+		}
+	} else if wlType == k8smanagersv1.Custom {
+		procedure.Namespace = namespace
+		resourceClient, err := r.customResource(cluster, procedure)
+		if err != nil {
+			return nil, err
+		}
+		list, err := resourceClient.List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			items = append(items, scheduling.NewUnstructuredWorkload(&list.Items[i], procedure.Custom.PodTemplatePath))
+		}
+	} else {
+		return nil, fmt.Errorf("unsupported type %q", wlType)
+	}
+
+	return items, nil
+}
@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"fmt"
+	k8smanagersv1 "greyridge.com/workloadManager/api/v1"
+	"strings"
+)
+
+// procedureDependencies returns the indexes of the procedures each procedure waits for. When no
+// procedure declares DependsOn the procedures run one after the other in list order, as they
+// always have. Otherwise list order is ignored and only DependsOn is followed. Unknown or
+// duplicate names and cycles are reported as errors.
+func procedureDependencies(procedures []k8smanagersv1.Procedure) ([][]int, error) {
+	deps := make([][]int, len(procedures))
+
+	if !hasDependsOn(procedures) {
+		for i := 1; i < len(procedures); i++ {
+			deps[i] = []int{i - 1}
+		}
+		return deps, nil
+	}
+
+	indexes := make(map[string]int, len(procedures))
+	for i, procedure := range procedures {
+		if procedure.Name == "" {
+			continue
+		}
+		if _, exists := indexes[procedure.Name]; exists {
+			return nil, fmt.Errorf("procedure name %q is used more than once", procedure.Name)
+		}
+		indexes[procedure.Name] = i
+	}
+
+	for i, procedure := range procedures {
+		for _, name := range procedure.DependsOn {
+			dep, exists := indexes[name]
+			if !exists {
+				return nil, fmt.Errorf("procedure %q depends on unknown procedure %q", procedureName(procedure, i), name)
+			}
+			deps[i] = append(deps[i], dep)
+		}
+	}
+
+	if cycle := findCycle(procedures, deps); cycle != nil {
+		return nil, fmt.Errorf("procedures depend on each other: %s", strings.Join(cycle, " -> "))
+	}
+	return deps, nil
+}
+
+// hasDependsOn checks if any procedure declares DependsOn, in which case list order is ignored
+func hasDependsOn(procedures []k8smanagersv1.Procedure) bool {
+	for _, procedure := range procedures {
+		if len(procedure.DependsOn) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// findCycle returns the names of the procedures along a dependency cycle, or nil when there is none
+func findCycle(procedures []k8smanagersv1.Procedure, deps [][]int) []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(procedures))
+	var path []int
+
+	var visit func(i int) []string
+	visit = func(i int) []string {
+		state[i] = visiting
+		path = append(path, i)
+		for _, dep := range deps[i] {
+			if state[dep] == visiting {
+				var cycle []string
+				for j := len(path) - 1; j >= 0; j-- {
+					cycle = append([]string{procedureName(procedures[path[j]], path[j])}, cycle...)
+					if path[j] == dep {
+						break
+					}
+				}
+				return append(cycle, procedureName(procedures[dep], dep))
+			}
+			if state[dep] == unvisited {
+				if cycle := visit(dep); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		return nil
+	}
+
+	for i := range procedures {
+		if state[i] == unvisited {
+			if cycle := visit(i); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
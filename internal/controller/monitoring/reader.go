@@ -0,0 +1,176 @@
+package monitoring
+
+import (
+	"context"
+	"fmt"
+	k8smanagersv1 "greyridge.com/workloadManager/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	batchlisters "k8s.io/client-go/listers/batch/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// Reader reads the objects the readiness of a workload is decided from
+type Reader interface {
+	GetDeployment(ctx context.Context, namespace string, name string) (*appsv1.Deployment, error)
+	GetStatefulSet(ctx context.Context, namespace string, name string) (*appsv1.StatefulSet, error)
+	GetDaemonSet(ctx context.Context, namespace string, name string) (*appsv1.DaemonSet, error)
+	GetCronJob(ctx context.Context, namespace string, name string) (*batchv1.CronJob, error)
+	GetJob(ctx context.Context, namespace string, name string) (*batchv1.Job, error)
+	ListJobs(ctx context.Context, namespace string) ([]batchv1.Job, error)
+	ListPods(ctx context.Context, namespace string, labelSelector string) ([]v1.Pod, error)
+}
+
+// clientsetReader reads from the API server
+type clientsetReader struct {
+	clientset kubernetes.Interface
+}
+
+func (r clientsetReader) GetDeployment(ctx context.Context, namespace string, name string) (*appsv1.Deployment, error) {
+	return r.clientset.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (r clientsetReader) GetStatefulSet(ctx context.Context, namespace string, name string) (*appsv1.StatefulSet, error) {
+	return r.clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (r clientsetReader) GetDaemonSet(ctx context.Context, namespace string, name string) (*appsv1.DaemonSet, error) {
+	return r.clientset.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (r clientsetReader) GetCronJob(ctx context.Context, namespace string, name string) (*batchv1.CronJob, error) {
+	return r.clientset.BatchV1().CronJobs(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (r clientsetReader) GetJob(ctx context.Context, namespace string, name string) (*batchv1.Job, error) {
+	return r.clientset.BatchV1().Jobs(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (r clientsetReader) ListJobs(ctx context.Context, namespace string) ([]batchv1.Job, error) {
+	jobs, err := r.clientset.BatchV1().Jobs(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return jobs.Items, nil
+}
+
+func (r clientsetReader) ListPods(ctx context.Context, namespace string, labelSelector string) ([]v1.Pod, error) {
+	pods, err := r.clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labelSelector,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pods.Items, nil
+}
+
+// Listers reads from the informers watching a workload. Objects of a kind whose lister is not
+// set are not watched and cannot be read. The objects read are shared with the informers and
+// must not be changed.
+type Listers struct {
+	Deployments  appslisters.DeploymentLister
+	StatefulSets appslisters.StatefulSetLister
+	DaemonSets   appslisters.DaemonSetLister
+	CronJobs     batchlisters.CronJobLister
+	Jobs         batchlisters.JobLister
+	Pods         corelisters.PodLister
+}
+
+func (r Listers) GetDeployment(_ context.Context, namespace string, name string) (*appsv1.Deployment, error) {
+	if r.Deployments == nil {
+		return nil, notWatched("deployments")
+	}
+	return r.Deployments.Deployments(namespace).Get(name)
+}
+
+func (r Listers) GetStatefulSet(_ context.Context, namespace string, name string) (*appsv1.StatefulSet, error) {
+	if r.StatefulSets == nil {
+		return nil, notWatched("statefulsets")
+	}
+	return r.StatefulSets.StatefulSets(namespace).Get(name)
+}
+
+func (r Listers) GetDaemonSet(_ context.Context, namespace string, name string) (*appsv1.DaemonSet, error) {
+	if r.DaemonSets == nil {
+		return nil, notWatched("daemonsets")
+	}
+	return r.DaemonSets.DaemonSets(namespace).Get(name)
+}
+
+func (r Listers) GetCronJob(_ context.Context, namespace string, name string) (*batchv1.CronJob, error) {
+	if r.CronJobs == nil {
+		return nil, notWatched("cronjobs")
+	}
+	return r.CronJobs.CronJobs(namespace).Get(name)
+}
+
+func (r Listers) GetJob(_ context.Context, namespace string, name string) (*batchv1.Job, error) {
+	if r.Jobs == nil {
+		return nil, notWatched("jobs")
+	}
+	return r.Jobs.Jobs(namespace).Get(name)
+}
+
+func (r Listers) ListJobs(_ context.Context, namespace string) ([]batchv1.Job, error) {
+	if r.Jobs == nil {
+		return nil, notWatched("jobs")
+	}
+	jobs, err := r.Jobs.Jobs(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	items := make([]batchv1.Job, 0, len(jobs))
+	for _, job := range jobs {
+		items = append(items, *job)
+	}
+	return items, nil
+}
+
+func (r Listers) ListPods(_ context.Context, namespace string, labelSelector string) ([]v1.Pod, error) {
+	if r.Pods == nil {
+		return nil, notWatched("pods")
+	}
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+	pods, err := r.Pods.Pods(namespace).List(selector)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]v1.Pod, 0, len(pods))
+	for _, pod := range pods {
+		items = append(items, *pod)
+	}
+	return items, nil
+}
+
+// Helper function to report a read of a kind the informers do not watch
+func notWatched(resource string) error {
+	return fmt.Errorf("%s are not watched", resource)
+}
+
+// GetWorkload reads the workload of type wlType through reader. Custom workloads cannot be read this way.
+func GetWorkload(ctx context.Context, reader Reader, wlType string, namespace string, name string) (interface{}, error) {
+	if wlType == k8smanagersv1.Deployment {
+		return reader.GetDeployment(ctx, namespace, name)
+	}
+	if wlType == k8smanagersv1.StatefulSet {
+		return reader.GetStatefulSet(ctx, namespace, name)
+	}
+	if wlType == k8smanagersv1.DaemonSet {
+		return reader.GetDaemonSet(ctx, namespace, name)
+	}
+	if wlType == k8smanagersv1.CronJob {
+		return reader.GetCronJob(ctx, namespace, name)
+	}
+	if wlType == k8smanagersv1.Job {
+		return reader.GetJob(ctx, namespace, name)
+	}
+	return nil, fmt.Errorf("unsupported workload type %s", wlType)
+}
@@ -4,78 +4,111 @@ import (
 	"context"
 	k8smanagersv1 "greyridge.com/workloadManager/api/v1"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"time"
 )
 
 func IsResourceReady(ctx context.Context, wlType string) bool {
+	// A check cut short by shutdown is not ready, the workload is checked again after the restart
+	if ctx.Err() != nil {
+		return false
+	}
+
 	namespace := ctx.Value("namespace").(string)
-	clientset := ctx.Value("clientset").(kubernetes.Interface)
+
+	// Watched workloads are read from their informers, the others from the API server
+	reader, ok := ctx.Value("reader").(Reader)
+	if !ok {
+		reader = clientsetReader{clientset: ctx.Value("clientset").(kubernetes.Interface)}
+	}
 
 	if wlType == k8smanagersv1.Deployment {
 		deployment := ctx.Value("resource").(*appsv1.Deployment)
-		return isDeploymentReady(clientset, namespace, deployment)
+		return isDeploymentReady(ctx, reader, namespace, deployment)
 	}
 	if wlType == k8smanagersv1.StatefulSet {
 		statefulset := ctx.Value("resource").(*appsv1.StatefulSet)
-		return isStatefulSetReady(clientset, namespace, statefulset)
+		return isStatefulSetReady(ctx, reader, namespace, statefulset)
+	}
+	if wlType == k8smanagersv1.DaemonSet {
+		daemonset := ctx.Value("resource").(*appsv1.DaemonSet)
+		return isDaemonSetReady(ctx, reader, namespace, daemonset)
+	}
+	if wlType == k8smanagersv1.CronJob {
+		cronjob := ctx.Value("resource").(*batchv1.CronJob)
+		since, _ := ctx.Value("startTime").(time.Time)
+		return isCronJobReady(ctx, reader, namespace, cronjob, since)
+	}
+	if wlType == k8smanagersv1.Job {
+		job := ctx.Value("resource").(*batchv1.Job)
+		return isJobReady(ctx, reader, namespace, job)
+	}
+	if wlType == k8smanagersv1.Custom {
+		object := ctx.Value("resource").(metav1.Object)
+		resourceClient := ctx.Value("dynamic").(dynamic.ResourceInterface)
+		return isCustomReady(ctx, resourceClient, object.GetName())
 	}
 	return false
 }
 
-func isDeploymentReady(clientset kubernetes.Interface, namespace string, deployment *appsv1.Deployment) bool {
+func isDeploymentReady(ctx context.Context, reader Reader, namespace string, deployment *appsv1.Deployment) bool {
 	l := log.Log
 	l.Info("Waiting to start...", "name", deployment.Name)
 
-	mondeployment, err := clientset.AppsV1().Deployments(namespace).Get(context.Background(), deployment.Name, metav1.GetOptions{})
+	mondeployment, err := reader.GetDeployment(ctx, namespace, deployment.Name)
 	if err != nil {
 		l.Error(err, "Could not monitor")
+		return false
 	}
 
-	labelSelector := metav1.FormatLabelSelector(mondeployment.Spec.Selector)
-	pods, err := getPodFromLabel(clientset, namespace, labelSelector)
-
-	var podname string = "UNKNOWN"
-	if len(pods.Items) > 0 {
-		podname = pods.Items[0].Name
+	// The rollout has not been picked up by the Deployment controller yet
+	if mondeployment.Status.ObservedGeneration < mondeployment.Generation {
+		return false
 	}
 
-	// Get the pod
-	pod, err := clientset.CoreV1().Pods(namespace).Get(context.Background(), podname, metav1.GetOptions{})
-	if err != nil {
-		l.Error(err, "Could not find pod named", "podname", podname)
+	// An unset replica count defaults to one
+	expectedReplicas := int32(1)
+	if mondeployment.Spec.Replicas != nil {
+		expectedReplicas = *mondeployment.Spec.Replicas
 	}
 
-	for _, condition := range pod.Status.Conditions {
-		if condition.Type == "Ready" && condition.Status == "True" {
-			creationTimestamp := pod.ObjectMeta.CreationTimestamp.Time
-			currentTime := time.Now()
-
-			l.Info("Pod started.", "name", deployment.Name, "start-up time", currentTime.Sub(creationTimestamp))
-			return true
-		}
+	// Every replica has to run the new template and be available, with no old replica left over
+	replicas := mondeployment.Status.Replicas
+	updated := mondeployment.Status.UpdatedReplicas
+	available := mondeployment.Status.AvailableReplicas
+	l.Info("Monitoring replicas", "expected", expectedReplicas, "replicas", replicas, "updated", updated, "available", available)
+	if updated == expectedReplicas && available == updated && replicas == updated {
+		l.Info("Deployment ready.", "name", deployment.Name)
+		return true
 	}
-
 	return false
 }
 
-func isStatefulSetReady(clientset kubernetes.Interface, namespace string, statefulset *appsv1.StatefulSet) bool {
+func isStatefulSetReady(ctx context.Context, reader Reader, namespace string, statefulset *appsv1.StatefulSet) bool {
 	l := log.Log
 	l.Info("Waiting to start...", "name", statefulset.Name)
 
-	monstatefulset, err := clientset.AppsV1().StatefulSets(namespace).Get(context.Background(), statefulset.Name, metav1.GetOptions{})
+	monstatefulset, err := reader.GetStatefulSet(ctx, namespace, statefulset.Name)
 	if err != nil {
 		l.Error(err, "Could not monitor")
+		return false
 	}
 
 	labelSelector := metav1.FormatLabelSelector(monstatefulset.Spec.Selector)
-	pods, err := getPodFromLabel(clientset, namespace, labelSelector)
+	pods, err := getPodFromLabel(ctx, reader, namespace, labelSelector)
+	if err != nil {
+		l.Error(err, "Could not list pods")
+		return false
+	}
 
 	// Print the status of each pod
-	for _, pod := range pods.Items {
+	for _, pod := range pods {
 		if pod.DeletionTimestamp != nil {
 			// One of the pods in the stateful set is term
 			l.Info("Pod is terminating", "name", pod.Name)
@@ -83,23 +116,202 @@ func isStatefulSetReady(clientset kubernetes.Interface, namespace string, statef
 		}
 	}
 
-	expectedReplicas := *monstatefulset.Spec.Replicas
+	// The rollout has not been picked up by the StatefulSet controller yet
+	if monstatefulset.Status.ObservedGeneration < monstatefulset.Generation {
+		return false
+	}
+
+	// An unset replica count defaults to one
+	expectedReplicas := int32(1)
+	if monstatefulset.Spec.Replicas != nil {
+		expectedReplicas = *monstatefulset.Spec.Replicas
+	}
+
+	// Every replica has to run the new revision and be ready, and the rollout has to be finished
+	updatedReplicas := monstatefulset.Status.UpdatedReplicas
 	readyReplicas := monstatefulset.Status.ReadyReplicas
-	l.Info("Monitoring replicas", "expected", expectedReplicas, "ready", readyReplicas)
-	if readyReplicas == expectedReplicas {
+	currentRevision := monstatefulset.Status.CurrentRevision
+	updateRevision := monstatefulset.Status.UpdateRevision
+	l.Info("Monitoring replicas", "expected", expectedReplicas, "updated", updatedReplicas, "ready", readyReplicas,
+		"currentRevision", currentRevision, "updateRevision", updateRevision)
+	if updatedReplicas == expectedReplicas && readyReplicas == expectedReplicas && currentRevision == updateRevision {
 		l.Info("Statefulset ready.", "name", statefulset.Name)
 		return true
 	}
 	return false
 }
 
-func getPodFromLabel(clientset kubernetes.Interface, namespace string, labelSelector string) (*v1.PodList, error) {
-	// List the pods matching the label selector
-	pods, err := clientset.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{
-		LabelSelector: labelSelector,
-	})
+func isDaemonSetReady(ctx context.Context, reader Reader, namespace string, daemonset *appsv1.DaemonSet) bool {
+	l := log.Log
+	l.Info("Waiting to start...", "name", daemonset.Name)
+
+	mondaemonset, err := reader.GetDaemonSet(ctx, namespace, daemonset.Name)
 	if err != nil {
-		return nil, err
+		l.Error(err, "Could not monitor")
+		return false
+	}
+
+	// The rollout has not been picked up by the DaemonSet controller yet
+	if mondaemonset.Status.ObservedGeneration < mondaemonset.Generation {
+		return false
 	}
-	return pods, nil
+
+	desired := mondaemonset.Status.DesiredNumberScheduled
+	updated := mondaemonset.Status.UpdatedNumberScheduled
+	ready := mondaemonset.Status.NumberReady
+	l.Info("Monitoring scheduled pods", "desired", desired, "updated", updated, "ready", ready)
+	if updated == desired && ready == desired {
+		l.Info("DaemonSet ready.", "name", daemonset.Name)
+		return true
+	}
+	return false
+}
+
+// isCronJobReady is true once the CronJob's template is on the new pool, which the patch has done, and
+// no run started before since is still going on the old pool. A run started after since has to have
+// a pod scheduled on a node, so a template that cannot be scheduled is caught. The next scheduled run
+// is not waited for, as it may be hours away. A suspended CronJob is always ready.
+func isCronJobReady(ctx context.Context, reader Reader, namespace string, cronjob *batchv1.CronJob, since time.Time) bool {
+	l := log.Log
+	l.Info("Waiting for earlier runs...", "name", cronjob.Name)
+
+	moncronjob, err := reader.GetCronJob(ctx, namespace, cronjob.Name)
+	if err != nil {
+		l.Error(err, "Could not monitor")
+		return false
+	}
+
+	if moncronjob.Spec.Suspend != nil && *moncronjob.Spec.Suspend {
+		l.Info("CronJob is suspended.", "name", cronjob.Name)
+		return true
+	}
+
+	jobs, err := reader.ListJobs(ctx, namespace)
+	if err != nil {
+		l.Error(err, "Could not list jobs")
+		return false
+	}
+
+	for _, job := range jobs {
+		if !metav1.IsControlledBy(&job, moncronjob) {
+			continue
+		}
+		if job.CreationTimestamp.Time.Before(since) {
+			if !isJobFinished(&job) {
+				l.Info("Earlier run still going.", "name", cronjob.Name, "job", job.Name)
+				return false
+			}
+			continue
+		}
+		if !isJobScheduled(ctx, reader, namespace, &job) {
+			l.Info("Run not scheduled yet.", "name", cronjob.Name, "job", job.Name)
+			return false
+		}
+	}
+
+	l.Info("CronJob ready.", "name", cronjob.Name)
+	return true
+}
+
+// isJobFinished is true when the Job has completed or failed
+func isJobFinished(job *batchv1.Job) bool {
+	for _, condition := range job.Status.Conditions {
+		if (condition.Type == batchv1.JobComplete || condition.Type == batchv1.JobFailed) && condition.Status == v1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// isJobReady is true when the Job is suspended, as it will start on the new pool once resumed,
+// or when it has finished or has a pod scheduled on a node
+func isJobReady(ctx context.Context, reader Reader, namespace string, job *batchv1.Job) bool {
+	l := log.Log
+	l.Info("Waiting to start...", "name", job.Name)
+
+	monjob, err := reader.GetJob(ctx, namespace, job.Name)
+	if err != nil {
+		l.Error(err, "Could not monitor")
+		return false
+	}
+
+	if monjob.Spec.Suspend != nil && *monjob.Spec.Suspend {
+		l.Info("Job is suspended.", "name", job.Name)
+		return true
+	}
+
+	if isJobScheduled(ctx, reader, namespace, monjob) {
+		l.Info("Job scheduled.", "name", job.Name)
+		return true
+	}
+	return false
+}
+
+// isJobScheduled is true when the Job has succeeded or one of its pods is bound to a node
+func isJobScheduled(ctx context.Context, reader Reader, namespace string, job *batchv1.Job) bool {
+	if job.Status.Succeeded > 0 {
+		return true
+	}
+	if job.Spec.Selector == nil {
+		return false
+	}
+
+	pods, err := getPodFromLabel(ctx, reader, namespace, metav1.FormatLabelSelector(job.Spec.Selector))
+	if err != nil {
+		return false
+	}
+	for _, pod := range pods {
+		if pod.Spec.NodeName != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// isCustomReady checks the status fields most workload kinds share. The workload is ready once
+// its observedGeneration has caught up, its Ready and Available conditions are not false and its
+// ready replicas match the desired replicas. Fields the kind does not have are not checked.
+func isCustomReady(ctx context.Context, resourceClient dynamic.ResourceInterface, name string) bool {
+	l := log.Log
+	l.Info("Waiting to start...", "name", name)
+
+	obj, err := resourceClient.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		l.Error(err, "Could not monitor")
+		return false
+	}
+
+	observedGeneration, found, _ := unstructured.NestedInt64(obj.Object, "status", "observedGeneration")
+	if found && observedGeneration < obj.GetGeneration() {
+		return false
+	}
+
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, item := range conditions {
+		condition, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if (condition["type"] == "Ready" || condition["type"] == "Available") && condition["status"] != "True" {
+			l.Info("Waiting for condition", "name", name, "condition", condition["type"])
+			return false
+		}
+	}
+
+	replicas, found, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+	if found {
+		readyReplicas, _, _ := unstructured.NestedInt64(obj.Object, "status", "readyReplicas")
+		l.Info("Monitoring replicas", "expected", replicas, "ready", readyReplicas)
+		if readyReplicas < replicas {
+			return false
+		}
+	}
+
+	l.Info("Workload ready.", "name", name)
+	return true
+}
+
+func getPodFromLabel(ctx context.Context, reader Reader, namespace string, labelSelector string) ([]v1.Pod, error) {
+	// List the pods matching the label selector
+	return reader.ListPods(ctx, namespace, labelSelector)
 }
@@ -7,32 +7,75 @@ import (
 	"github.com/stretchr/testify/assert"
 	k8smanagersv1 "greyridge.com/workloadManager/api/v1"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/kubernetes/fake"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"time"
 )
 
 func TestIsResourceReady(t *testing.T) {
 	namespace := "test-namespace"
 	deploymentName := "test-deployment"
 	statefulsetName := "test-statefulset"
+	daemonsetName := "test-daemonset"
+	rollingName := "test-daemonset-rolling"
+	rolloutName := "test-deployment-rolling"
+	updatingName := "test-statefulset-updating"
 
 	clientset := fake.NewClientset(
 		&appsv1.Deployment{
 			ObjectMeta: metav1.ObjectMeta{
-				Name:      deploymentName,
-				Namespace: namespace,
+				Name:       deploymentName,
+				Namespace:  namespace,
+				Generation: 2,
 			},
 			Spec: appsv1.DeploymentSpec{
 				Selector: &metav1.LabelSelector{
 					MatchLabels: map[string]string{"app": "test"},
 				},
+				Replicas: int32Ptr(2),
+			},
+			Status: appsv1.DeploymentStatus{
+				ObservedGeneration: 2,
+				Replicas:           2,
+				UpdatedReplicas:    2,
+				AvailableReplicas:  2,
+			},
+		},
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:       rolloutName,
+				Namespace:  namespace,
+				Generation: 2,
+			},
+			Spec: appsv1.DeploymentSpec{
+				Selector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"app": "test"},
+				},
+				Replicas: int32Ptr(2),
+			},
+			Status: appsv1.DeploymentStatus{
+				ObservedGeneration: 2,
+				Replicas:           3,
+				UpdatedReplicas:    1,
+				AvailableReplicas:  2,
 			},
 		},
 		&appsv1.StatefulSet{
 			ObjectMeta: metav1.ObjectMeta{
-				Name:      statefulsetName,
-				Namespace: namespace,
+				Name:       statefulsetName,
+				Namespace:  namespace,
+				Generation: 2,
 			},
 			Spec: appsv1.StatefulSetSpec{
 				Selector: &metav1.LabelSelector{
@@ -41,7 +84,57 @@ func TestIsResourceReady(t *testing.T) {
 				Replicas: int32Ptr(1),
 			},
 			Status: appsv1.StatefulSetStatus{
-				ReadyReplicas: 1,
+				ObservedGeneration: 2,
+				ReadyReplicas:      1,
+				UpdatedReplicas:    1,
+				CurrentRevision:    "test-statefulset-2",
+				UpdateRevision:     "test-statefulset-2",
+			},
+		},
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:       updatingName,
+				Namespace:  namespace,
+				Generation: 2,
+			},
+			Spec: appsv1.StatefulSetSpec{
+				Selector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"app": "test"},
+				},
+				Replicas: int32Ptr(1),
+			},
+			Status: appsv1.StatefulSetStatus{
+				ObservedGeneration: 2,
+				ReadyReplicas:      1,
+				UpdatedReplicas:    0,
+				CurrentRevision:    "test-statefulset-updating-1",
+				UpdateRevision:     "test-statefulset-updating-2",
+			},
+		},
+		&appsv1.DaemonSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:       daemonsetName,
+				Namespace:  namespace,
+				Generation: 2,
+			},
+			Status: appsv1.DaemonSetStatus{
+				ObservedGeneration:     2,
+				DesiredNumberScheduled: 3,
+				UpdatedNumberScheduled: 3,
+				NumberReady:            3,
+			},
+		},
+		&appsv1.DaemonSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:       rollingName,
+				Namespace:  namespace,
+				Generation: 2,
+			},
+			Status: appsv1.DaemonSetStatus{
+				ObservedGeneration:     2,
+				DesiredNumberScheduled: 3,
+				UpdatedNumberScheduled: 1,
+				NumberReady:            3,
 			},
 		},
 		&v1.Pod{
@@ -71,11 +164,301 @@ func TestIsResourceReady(t *testing.T) {
 	})
 	assert.True(t, IsResourceReady(ctx, k8smanagersv1.Deployment))
 
+	// Test Deployment whose new ReplicaSet is not ready while the old pod still is
+	ctx = context.WithValue(ctx, "resource", &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: rolloutName},
+	})
+	assert.False(t, IsResourceReady(ctx, k8smanagersv1.Deployment))
+
 	// Test StatefulSet readiness
 	ctx = context.WithValue(ctx, "resource", &appsv1.StatefulSet{
 		ObjectMeta: metav1.ObjectMeta{Name: statefulsetName},
 	})
 	assert.True(t, IsResourceReady(ctx, k8smanagersv1.StatefulSet))
+
+	// Test StatefulSet whose ready pod still runs the old revision
+	ctx = context.WithValue(ctx, "resource", &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: updatingName},
+	})
+	assert.False(t, IsResourceReady(ctx, k8smanagersv1.StatefulSet))
+
+	// Test DaemonSet readiness
+	ctx = context.WithValue(ctx, "resource", &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Name: daemonsetName},
+	})
+	assert.True(t, IsResourceReady(ctx, k8smanagersv1.DaemonSet))
+
+	// Test DaemonSet still rolling out
+	ctx = context.WithValue(ctx, "resource", &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Name: rollingName},
+	})
+	assert.False(t, IsResourceReady(ctx, k8smanagersv1.DaemonSet))
+
+	// Test a cancelled check is never ready
+	ctx = context.WithValue(ctx, "resource", &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: deploymentName},
+	})
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.False(t, IsResourceReady(cancelled, k8smanagersv1.Deployment))
+}
+
+func TestIsResourceReadyOnAPIError(t *testing.T) {
+	namespace := "test-namespace"
+
+	clientset := fake.NewClientset(
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-statefulset", Namespace: namespace},
+			Spec: appsv1.StatefulSetSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "test"}},
+				Replicas: int32Ptr(1),
+			},
+		},
+	)
+	// Calls cut short by shutdown fail with the context error
+	clientset.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, context.Canceled
+	})
+
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, "namespace", namespace)
+	ctx = context.WithValue(ctx, "clientset", clientset)
+
+	// Test StatefulSet when listing its pods fails
+	ctx = context.WithValue(ctx, "resource", &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-statefulset"},
+	})
+	assert.False(t, IsResourceReady(ctx, k8smanagersv1.StatefulSet))
+
+	// Test Deployment and StatefulSet when getting them fails
+	ctx = context.WithValue(ctx, "resource", &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "missing-deployment"},
+	})
+	assert.False(t, IsResourceReady(ctx, k8smanagersv1.Deployment))
+
+	ctx = context.WithValue(ctx, "resource", &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "missing-statefulset"},
+	})
+	assert.False(t, IsResourceReady(ctx, k8smanagersv1.StatefulSet))
+}
+
+func TestIsResourceReadyFromListers(t *testing.T) {
+	namespace := "test-namespace"
+
+	deployments := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	pods := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	_ = deployments.Add(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-deployment", Namespace: namespace, Generation: 1},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "test"}},
+		},
+		Status: appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1},
+	})
+	_ = pods.Add(&v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: namespace, Labels: map[string]string{"app": "test"}},
+		Status: v1.PodStatus{
+			Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+		},
+	})
+
+	// No clientset: everything is read from the informer caches
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, "namespace", namespace)
+	ctx = context.WithValue(ctx, "reader", Listers{
+		Deployments: appslisters.NewDeploymentLister(deployments),
+		Pods:        corelisters.NewPodLister(pods),
+	})
+
+	ctx = context.WithValue(ctx, "resource", &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-deployment"},
+	})
+	assert.True(t, IsResourceReady(ctx, k8smanagersv1.Deployment))
+
+	// Test Deployment missing from the cache
+	ctx = context.WithValue(ctx, "resource", &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "missing-deployment"},
+	})
+	assert.False(t, IsResourceReady(ctx, k8smanagersv1.Deployment))
+
+	// Test StatefulSet, which is not watched
+	ctx = context.WithValue(ctx, "resource", &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-deployment"},
+	})
+	assert.False(t, IsResourceReady(ctx, k8smanagersv1.StatefulSet))
+}
+
+func TestIsBatchResourceReady(t *testing.T) {
+	namespace := "test-namespace"
+	suspend := true
+	since := time.Now()
+
+	cronjob := &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-cronjob",
+			Namespace: namespace,
+			UID:       types.UID("cronjob-uid"),
+		},
+	}
+	controller := true
+
+	clientset := fake.NewClientset(
+		cronjob,
+		&batchv1.CronJob{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-cronjob-suspended",
+				Namespace: namespace,
+			},
+			Spec: batchv1.CronJobSpec{
+				Suspend: &suspend,
+			},
+		},
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "test-cronjob-1",
+				Namespace:         namespace,
+				CreationTimestamp: metav1.NewTime(since.Add(time.Minute)),
+				OwnerReferences: []metav1.OwnerReference{
+					{Kind: "CronJob", Name: cronjob.Name, UID: cronjob.UID, Controller: &controller},
+				},
+			},
+			Spec: batchv1.JobSpec{
+				Selector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"job-name": "test-cronjob-1"},
+				},
+			},
+		},
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "test-cronjob-0",
+				Namespace:         namespace,
+				CreationTimestamp: metav1.NewTime(since.Add(-time.Hour)),
+				OwnerReferences: []metav1.OwnerReference{
+					{Kind: "CronJob", Name: cronjob.Name, UID: cronjob.UID, Controller: &controller},
+				},
+			},
+			Status: batchv1.JobStatus{
+				Conditions: []batchv1.JobCondition{
+					{Type: batchv1.JobComplete, Status: v1.ConditionTrue},
+				},
+			},
+		},
+		&batchv1.CronJob{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-cronjob-daily",
+				Namespace: namespace,
+			},
+			Spec: batchv1.CronJobSpec{
+				Schedule: "0 3 * * *",
+			},
+		},
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-job",
+				Namespace: namespace,
+			},
+			Spec: batchv1.JobSpec{
+				Suspend: &suspend,
+			},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-cronjob-1-pod",
+				Namespace: namespace,
+				Labels:    map[string]string{"job-name": "test-cronjob-1"},
+			},
+			Spec: v1.PodSpec{
+				NodeName: "aks-miscgreen-0",
+			},
+		},
+	)
+
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, "namespace", namespace)
+	ctx = context.WithValue(ctx, "clientset", clientset)
+	ctx = context.WithValue(ctx, "startTime", since)
+
+	// Test CronJob with a run scheduled after the change
+	ctx = context.WithValue(ctx, "resource", cronjob)
+	assert.True(t, IsResourceReady(ctx, k8smanagersv1.CronJob))
+
+	// Test CronJob with a run from before the change still going
+	ctx = context.WithValue(ctx, "startTime", since.Add(time.Hour))
+	assert.False(t, IsResourceReady(ctx, k8smanagersv1.CronJob))
+
+	// Test daily CronJob without any run is ready without waiting for the next one
+	ctx = context.WithValue(ctx, "resource", &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-cronjob-daily"},
+	})
+	assert.True(t, IsResourceReady(ctx, k8smanagersv1.CronJob))
+
+	// Test suspended CronJob
+	ctx = context.WithValue(ctx, "resource", &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-cronjob-suspended"},
+	})
+	assert.True(t, IsResourceReady(ctx, k8smanagersv1.CronJob))
+
+	// Test suspended Job
+	ctx = context.WithValue(ctx, "resource", &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-job"},
+	})
+	assert.True(t, IsResourceReady(ctx, k8smanagersv1.Job))
+}
+
+func newRollout(name string, readyReplicas int64, available string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "argoproj.io/v1alpha1",
+			"kind":       "Rollout",
+			"metadata": map[string]interface{}{
+				"name":       name,
+				"namespace":  "test-namespace",
+				"generation": int64(2),
+			},
+			"spec": map[string]interface{}{
+				"replicas": int64(2),
+			},
+			"status": map[string]interface{}{
+				"observedGeneration": int64(2),
+				"readyReplicas":      readyReplicas,
+				"conditions": []interface{}{
+					map[string]interface{}{"type": "Available", "status": available},
+				},
+			},
+		},
+	}
+}
+
+func TestIsCustomResourceReady(t *testing.T) {
+	gvr := schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"}
+
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{gvr: "RolloutList"},
+		newRollout("ready-rollout", 2, "True"),
+		newRollout("scaling-rollout", 1, "True"),
+		newRollout("unavailable-rollout", 2, "False"),
+	)
+
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, "namespace", "test-namespace")
+	ctx = context.WithValue(ctx, "clientset", fake.NewClientset())
+	ctx = context.WithValue(ctx, "dynamic", client.Resource(gvr).Namespace("test-namespace"))
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "ready-rollout", want: true},
+		{name: "scaling-rollout", want: false},
+		{name: "unavailable-rollout", want: false},
+		{name: "missing-rollout", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.WithValue(ctx, "resource", newRollout(tt.name, 0, ""))
+			assert.Equal(t, tt.want, IsResourceReady(ctx, k8smanagersv1.Custom))
+		})
+	}
 }
 
 func int32Ptr(i int32) *int32 {
@@ -1,8 +1,10 @@
 package scheduling
 
 import (
+	"fmt"
 	k8smanagersv1 "greyridge.com/workloadManager/api/v1"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/api/core/v1"
 	"sigs.k8s.io/controller-runtime/pkg/log"
@@ -15,11 +17,22 @@ func HasAffinity(resource interface{}) bool {
 		return hasDeploymentAffinity(obj)
 	case *appsv1.StatefulSet:
 		return hasStatefulSetAffinity(obj)
+	case *appsv1.DaemonSet:
+		return hasDaemonSetAffinity(obj)
+	case *batchv1.CronJob:
+		return hasCronJobAffinity(obj)
+	case *batchv1.Job:
+		return hasJobAffinity(obj)
+	case *UnstructuredWorkload:
+		podSpec := obj.podSpec()
+		return podSpec != nil && hasPodSpecNodeAffinity(podSpec)
 	default:
 		return false
 	}
 }
 
+// CheckNodeAffinity checks the affinity carries the procedure's Initial value. A mismatch is
+// logged when the procedure's OnMismatch policy is warn, otherwise ErrInitialMismatch is returned.
 func CheckNodeAffinity(affinity *v1.NodeAffinity, procedure k8smanagersv1.Procedure, wlName string) error {
 	l := log.Log
 
@@ -28,21 +41,19 @@ func CheckNodeAffinity(affinity *v1.NodeAffinity, procedure k8smanagersv1.Proced
 	}
 
 	checkOk := false
-	for _, terms := range affinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
-		for _, expressions := range terms.MatchExpressions {
-			if expressions.Key == procedure.Affinity.Key {
-				for _, value := range expressions.Values {
-					if value == procedure.Affinity.Initial {
-						checkOk = true
-					}
-				}
-			}
+	for _, value := range getAffinityValues(affinity, procedure.Affinity.Key) {
+		if value == procedure.Affinity.Initial {
+			checkOk = true
 		}
 	}
 
 	if checkOk == false {
-		l.Info("resource does not have the expected node affinity", "workload name", wlName, "affinity key", procedure.Affinity.Key, "expected value", procedure.Affinity.Initial)
-		l.Info("Continuing...")
+		if isWarnOnMismatch(procedure) {
+			l.Info("resource does not have the expected node affinity", "workload name", wlName, "affinity key", procedure.Affinity.Key, "expected value", procedure.Affinity.Initial)
+			l.Info("Continuing...")
+			return nil
+		}
+		return fmt.Errorf("%w: node affinity %s is not %s", ErrInitialMismatch, procedure.Affinity.Key, procedure.Affinity.Initial)
 	}
 	return nil
 }
@@ -67,6 +78,80 @@ func CreateNodeAffinity(key string, value string) *v1.NodeAffinity {
 	return nodeAffinity
 }
 
+// UpdateNodeAffinity returns a copy of the affinity with every In expression on key pointing at
+// value. All other expressions, terms and preferred weights are kept as they are. Required terms
+// without an In expression on key have one added, unless the key only appears in preferred terms.
+// An empty key leaves the affinity as it is.
+func UpdateNodeAffinity(affinity *v1.NodeAffinity, key string, value string) *v1.NodeAffinity {
+	if key == "" {
+		return affinity.DeepCopy()
+	}
+	if affinity == nil {
+		return CreateNodeAffinity(key, value)
+	}
+
+	updated := affinity.DeepCopy()
+
+	preferredFound := false
+	for i := range updated.PreferredDuringSchedulingIgnoredDuringExecution {
+		preference := &updated.PreferredDuringSchedulingIgnoredDuringExecution[i].Preference
+		if updateExpressions(preference.MatchExpressions, key, value) {
+			preferredFound = true
+		}
+	}
+
+	required := updated.RequiredDuringSchedulingIgnoredDuringExecution
+	if required == nil || len(required.NodeSelectorTerms) == 0 {
+		if !preferredFound {
+			updated.RequiredDuringSchedulingIgnoredDuringExecution = CreateNodeAffinity(key, value).RequiredDuringSchedulingIgnoredDuringExecution
+		}
+		return updated
+	}
+
+	for i := range required.NodeSelectorTerms {
+		term := &required.NodeSelectorTerms[i]
+		if !updateExpressions(term.MatchExpressions, key, value) {
+			term.MatchExpressions = append(term.MatchExpressions, v1.NodeSelectorRequirement{
+				Key:      key,
+				Operator: v1.NodeSelectorOpIn,
+				Values:   []string{value},
+			})
+		}
+	}
+
+	return updated
+}
+
+// Helper function to point every In expression on key at value
+func updateExpressions(expressions []v1.NodeSelectorRequirement, key string, value string) bool {
+	found := false
+	for i := range expressions {
+		if expressions[i].Key == key && expressions[i].Operator == v1.NodeSelectorOpIn {
+			expressions[i].Values = []string{value}
+			found = true
+		}
+	}
+	return found
+}
+
+// Helper function to get the values of every required In expression matching key
+func getAffinityValues(affinity *v1.NodeAffinity, key string) []string {
+	var values []string
+
+	if affinity == nil || affinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return values
+	}
+
+	for _, terms := range affinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		for _, expressions := range terms.MatchExpressions {
+			if expressions.Key == key && expressions.Operator == v1.NodeSelectorOpIn {
+				values = append(values, expressions.Values...)
+			}
+		}
+	}
+	return values
+}
+
 // Helper function to check Selector for Deployment
 func hasDeploymentAffinity(deployment *appsv1.Deployment) bool {
 	return hasPodSpecNodeAffinity(&deployment.Spec.Template.Spec)
@@ -77,6 +162,21 @@ func hasStatefulSetAffinity(statefulset *appsv1.StatefulSet) bool {
 	return hasPodSpecNodeAffinity(&statefulset.Spec.Template.Spec)
 }
 
+// Helper function to check Selector for DaemonSet
+func hasDaemonSetAffinity(daemonset *appsv1.DaemonSet) bool {
+	return hasPodSpecNodeAffinity(&daemonset.Spec.Template.Spec)
+}
+
+// Helper function to check Selector for CronJob
+func hasCronJobAffinity(cronjob *batchv1.CronJob) bool {
+	return hasPodSpecNodeAffinity(&cronjob.Spec.JobTemplate.Spec.Template.Spec)
+}
+
+// Helper function to check Selector for Job
+func hasJobAffinity(job *batchv1.Job) bool {
+	return hasPodSpecNodeAffinity(&job.Spec.Template.Spec)
+}
+
 func hasPodSpecNodeAffinity(podSpec *corev1.PodSpec) bool {
 	if podSpec.Affinity == nil {
 		return false
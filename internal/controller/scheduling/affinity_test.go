@@ -97,6 +97,48 @@ func TestHasAffinity(t *testing.T) {
 			},
 			want: false,
 		},
+		{
+			name: "DaemonSet with Node Affinity",
+			resource: &appsv1.DaemonSet{
+				Spec: appsv1.DaemonSetSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							Affinity: &corev1.Affinity{
+								NodeAffinity: &corev1.NodeAffinity{
+									RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+										NodeSelectorTerms: []corev1.NodeSelectorTerm{
+											{
+												MatchExpressions: []corev1.NodeSelectorRequirement{
+													{
+														Key:      "key1",
+														Operator: corev1.NodeSelectorOpIn,
+														Values:   []string{"value1"},
+													},
+												},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			want: true,
+		},
+		{
+			name: "DaemonSet without Node Affinity",
+			resource: &appsv1.DaemonSet{
+				Spec: appsv1.DaemonSetSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							Affinity: nil,
+						},
+					},
+				},
+			},
+			want: false,
+		},
 		{
 			name:     "Invalid resource type",
 			resource: &struct{}{},
@@ -173,6 +215,61 @@ func TestCheckNodeAffinity(t *testing.T) {
 			wlName:  "workload1",
 			wantErr: false,
 		},
+		{
+			name: "Affinity without matching value and fail on mismatch",
+			affinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+					NodeSelectorTerms: []corev1.NodeSelectorTerm{
+						{
+							MatchExpressions: []corev1.NodeSelectorRequirement{
+								{
+									Key:      "node-type",
+									Operator: corev1.NodeSelectorOpIn,
+									Values:   []string{"initial"},
+								},
+							},
+						},
+					},
+				},
+			},
+			procedure: k8smanagersv1.Procedure{
+				Affinity: k8smanagersv1.Affinity{
+					Key:     "node-type",
+					Initial: "non-matching-value",
+				},
+				OnMismatch: k8smanagersv1.MismatchFail,
+			},
+			wlName:  "workload1",
+			wantErr: true,
+		},
+		{
+			name: "Affinity without matching value and skip on mismatch",
+			affinity: &corev1.NodeAffinity{
+				PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{
+					{
+						Weight: 1,
+						Preference: corev1.NodeSelectorTerm{
+							MatchExpressions: []corev1.NodeSelectorRequirement{
+								{
+									Key:      "node-type",
+									Operator: corev1.NodeSelectorOpIn,
+									Values:   []string{"initial"},
+								},
+							},
+						},
+					},
+				},
+			},
+			procedure: k8smanagersv1.Procedure{
+				Affinity: k8smanagersv1.Affinity{
+					Key:     "node-type",
+					Initial: "initial",
+				},
+				OnMismatch: k8smanagersv1.MismatchSkip,
+			},
+			wlName:  "workload1",
+			wantErr: true,
+		},
 		{
 			name:      "Nil affinity",
 			affinity:  nil,
@@ -261,3 +358,106 @@ func TestCreateNodeAffinity(t *testing.T) {
 		})
 	}
 }
+
+func TestUpdateNodeAffinity(t *testing.T) {
+	affinity := &corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{
+				{
+					MatchExpressions: []corev1.NodeSelectorRequirement{
+						{
+							Key:      "agentpool",
+							Operator: corev1.NodeSelectorOpIn,
+							Values:   []string{"servicesblue"},
+						},
+						{
+							Key:      "kubernetes.azure.com/scalesetpriority",
+							Operator: corev1.NodeSelectorOpNotIn,
+							Values:   []string{"spot"},
+						},
+					},
+				},
+				{
+					MatchExpressions: []corev1.NodeSelectorRequirement{
+						{
+							Key:      "topology.kubernetes.io/zone",
+							Operator: corev1.NodeSelectorOpIn,
+							Values:   []string{"westeurope-1"},
+						},
+					},
+				},
+			},
+		},
+		PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{
+			{
+				Weight: 50,
+				Preference: corev1.NodeSelectorTerm{
+					MatchExpressions: []corev1.NodeSelectorRequirement{
+						{
+							Key:      "kubernetes.io/arch",
+							Operator: corev1.NodeSelectorOpIn,
+							Values:   []string{"amd64"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	got := UpdateNodeAffinity(affinity, "agentpool", "servicesgreen")
+
+	terms := got.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	if len(terms) != 2 {
+		t.Fatalf("UpdateNodeAffinity() terms = %v, want 2", len(terms))
+	}
+
+	first := terms[0].MatchExpressions
+	if len(first) != 2 || first[0].Values[0] != "servicesgreen" {
+		t.Errorf("UpdateNodeAffinity() first term = %v, want agentpool In servicesgreen", first)
+	}
+	if first[1].Operator != corev1.NodeSelectorOpNotIn || first[1].Values[0] != "spot" {
+		t.Errorf("UpdateNodeAffinity() first term = %v, want spot exclusion kept", first)
+	}
+
+	second := terms[1].MatchExpressions
+	if len(second) != 2 || second[0].Key != "topology.kubernetes.io/zone" || second[1].Values[0] != "servicesgreen" {
+		t.Errorf("UpdateNodeAffinity() second term = %v, want zone kept and agentpool added", second)
+	}
+
+	preferred := got.PreferredDuringSchedulingIgnoredDuringExecution
+	if len(preferred) != 1 || preferred[0].Weight != 50 || preferred[0].Preference.MatchExpressions[0].Values[0] != "amd64" {
+		t.Errorf("UpdateNodeAffinity() preferred = %v, want untouched", preferred)
+	}
+
+	if affinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions[0].Values[0] != "servicesblue" {
+		t.Errorf("UpdateNodeAffinity() modified the original affinity")
+	}
+
+	if got := UpdateNodeAffinity(nil, "agentpool", "servicesgreen"); getAffinityValues(got, "agentpool")[0] != "servicesgreen" {
+		t.Errorf("UpdateNodeAffinity() = %v, want new affinity for nil", got)
+	}
+
+	// A selector-only procedure has no affinity key and must not touch unrelated terms
+	arch := &corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{
+				{
+					MatchExpressions: []corev1.NodeSelectorRequirement{
+						{
+							Key:      "kubernetes.io/arch",
+							Operator: corev1.NodeSelectorOpIn,
+							Values:   []string{"amd64"},
+						},
+					},
+				},
+			},
+		},
+	}
+	unchanged := UpdateNodeAffinity(arch, "", "")
+	if expressions := unchanged.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions; len(expressions) != 1 || expressions[0].Key != "kubernetes.io/arch" {
+		t.Errorf("UpdateNodeAffinity() with empty key = %v, want unchanged", expressions)
+	}
+	if got := UpdateNodeAffinity(nil, "", ""); got != nil {
+		t.Errorf("UpdateNodeAffinity() with empty key = %v, want nil for nil", got)
+	}
+}
@@ -0,0 +1,159 @@
+package scheduling
+
+import (
+	"encoding/json"
+	k8smanagersv1 "greyridge.com/workloadManager/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// FieldManager is the field manager recorded against every change made by the controller
+const FieldManager = "workloadmanager"
+
+// AffinityFieldManager is the field manager owning the node affinity the procedures apply
+const AffinityFieldManager = FieldManager + "-affinity"
+
+// SelectorFieldManager returns the field manager owning the node selector key the procedures apply
+func SelectorFieldManager(key string) string {
+	return FieldManager + "-selector-" + key
+}
+
+// ApplyPatch is a server-side apply patch and the field manager it is sent as
+type ApplyPatch struct {
+	FieldManager string
+	Data         []byte
+}
+
+// TargetApplyPatches returns the server-side apply patches moving the resource to the procedure's
+// Target. The patches only hold the node affinity and the node selector key, so no other field of
+// the resource is claimed. Each is sent as its own field manager: a manager gives up the fields it
+// leaves out of an apply, so a procedure moving only the selector would otherwise drop the affinity
+// an earlier procedure set. A part of the procedure without a key is left out.
+func TargetApplyPatches(resource interface{}, procedure k8smanagersv1.Procedure) ([]ApplyPatch, error) {
+	podSpec := getPodSpec(resource)
+	if podSpec == nil {
+		return nil, nil
+	}
+
+	var patches []ApplyPatch
+
+	if procedure.Affinity.Key != "" && hasPodSpecNodeAffinity(podSpec) {
+		data, err := applyPatch(resource, map[string]interface{}{
+			"affinity": map[string]interface{}{
+				"nodeAffinity": UpdateNodeAffinity(podSpec.Affinity.NodeAffinity, procedure.Affinity.Key, procedure.Affinity.Target),
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		patches = append(patches, ApplyPatch{FieldManager: AffinityFieldManager, Data: data})
+	}
+	if procedure.Selector.Key != "" && hasNodeSelector(podSpec.NodeSelector) && !procedure.Selector.Remove {
+		data, err := applyPatch(resource, map[string]interface{}{
+			"nodeSelector": CreateNodeSelector(procedure.Selector.Key, procedure.Selector.Target),
+		})
+		if err != nil {
+			return nil, err
+		}
+		patches = append(patches, ApplyPatch{FieldManager: SelectorFieldManager(procedure.Selector.Key), Data: data})
+	}
+
+	return patches, nil
+}
+
+// Helper function to build an apply patch setting the scheduling fields of the resource's pod spec
+func applyPatch(resource interface{}, scheduling map[string]interface{}) ([]byte, error) {
+	apiVersion, kind, path := getTemplateInfo(resource)
+	object := resource.(metav1.Object)
+
+	patch := map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       kind,
+		"metadata": map[string]interface{}{
+			"name":      object.GetName(),
+			"namespace": object.GetNamespace(),
+		},
+	}
+	setPath(patch, path, scheduling)
+
+	return json.Marshal(patch)
+}
+
+// RemoveSelectorPatch returns a merge patch deleting the procedure's selector key from the
+// resource. Server-side apply cannot remove a key owned by another manager, so removal is
+// sent separately. A nil patch is returned when there is nothing to remove.
+func RemoveSelectorPatch(resource interface{}, procedure k8smanagersv1.Procedure) ([]byte, error) {
+	podSpec := getPodSpec(resource)
+	if podSpec == nil || !procedure.Selector.Remove || procedure.Selector.Key == "" {
+		return nil, nil
+	}
+
+	if _, exists := podSpec.NodeSelector[procedure.Selector.Key]; !exists {
+		return nil, nil
+	}
+
+	_, _, path := getTemplateInfo(resource)
+
+	patch := map[string]interface{}{}
+	setPath(patch, path, map[string]interface{}{
+		"nodeSelector": map[string]interface{}{
+			procedure.Selector.Key: nil,
+		},
+	})
+
+	return json.Marshal(patch)
+}
+
+// RestoreSelectorPatch returns a merge patch adding the procedure's selector key back with its
+// Initial value after it has been removed. A nil patch is returned when there is nothing to restore.
+func RestoreSelectorPatch(resource interface{}, procedure k8smanagersv1.Procedure) ([]byte, error) {
+	podSpec := getPodSpec(resource)
+	if podSpec == nil || !procedure.Selector.Remove || procedure.Selector.Key == "" {
+		return nil, nil
+	}
+
+	if _, exists := podSpec.NodeSelector[procedure.Selector.Key]; exists {
+		return nil, nil
+	}
+
+	_, _, path := getTemplateInfo(resource)
+
+	patch := map[string]interface{}{}
+	setPath(patch, path, map[string]interface{}{
+		"nodeSelector": CreateNodeSelector(procedure.Selector.Key, procedure.Selector.Initial),
+	})
+
+	return json.Marshal(patch)
+}
+
+// Helper function to get the apiVersion, kind and pod spec path of the resource
+func getTemplateInfo(resource interface{}) (string, string, []string) {
+	switch obj := resource.(type) {
+	case *appsv1.Deployment:
+		return appsv1.SchemeGroupVersion.String(), "Deployment", []string{"spec", "template", "spec"}
+	case *appsv1.StatefulSet:
+		return appsv1.SchemeGroupVersion.String(), "StatefulSet", []string{"spec", "template", "spec"}
+	case *appsv1.DaemonSet:
+		return appsv1.SchemeGroupVersion.String(), "DaemonSet", []string{"spec", "template", "spec"}
+	case *batchv1.CronJob:
+		return batchv1.SchemeGroupVersion.String(), "CronJob", []string{"spec", "jobTemplate", "spec", "template", "spec"}
+	case *batchv1.Job:
+		return batchv1.SchemeGroupVersion.String(), "Job", []string{"spec", "template", "spec"}
+	case *UnstructuredWorkload:
+		return obj.GetAPIVersion(), obj.GetKind(), obj.podSpecPath()
+	default:
+		return "", "", nil
+	}
+}
+
+// Helper function to set value at path, creating the intermediate maps
+func setPath(object map[string]interface{}, path []string, value map[string]interface{}) {
+	current := object
+	for _, field := range path[:len(path)-1] {
+		next := map[string]interface{}{}
+		current[field] = next
+		current = next
+	}
+	current[path[len(path)-1]] = value
+}
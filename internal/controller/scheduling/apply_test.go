@@ -0,0 +1,276 @@
+package scheduling
+
+import (
+	"encoding/json"
+	"testing"
+
+	k8smanagersv1 "greyridge.com/workloadManager/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newApplyDeployment() *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-deployment",
+			Namespace: "default",
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					NodeSelector: map[string]string{
+						"pasx/node":        "miscblue",
+						"kubernetes.io/os": "linux",
+					},
+				},
+			},
+		},
+	}
+}
+
+// TestTargetApplyPatches tests the TargetApplyPatches function
+func TestTargetApplyPatches(t *testing.T) {
+	procedure := k8smanagersv1.Procedure{
+		Selector: k8smanagersv1.Selector{
+			Key:     "pasx/node",
+			Initial: "miscblue",
+			Target:  "miscgreen",
+		},
+	}
+
+	data := singleApplyPatch(t, newApplyDeployment(), procedure, SelectorFieldManager("pasx/node"))
+
+	patch := &appsv1.Deployment{}
+	if err := json.Unmarshal(data, patch); err != nil {
+		t.Fatalf("Expected a Deployment patch, got %v", err)
+	}
+
+	if patch.APIVersion != "apps/v1" || patch.Kind != "Deployment" || patch.Name != "test-deployment" || patch.Namespace != "default" {
+		t.Errorf("Expected Deployment default/test-deployment, got %s %s %s/%s", patch.APIVersion, patch.Kind, patch.Namespace, patch.Name)
+	}
+
+	nodeSelector := patch.Spec.Template.Spec.NodeSelector
+	if len(nodeSelector) != 1 || nodeSelector["pasx/node"] != "miscgreen" {
+		t.Errorf("Expected only pasx/node=miscgreen in the patch, got %v", nodeSelector)
+	}
+	if patch.Spec.Template.Spec.Affinity != nil {
+		t.Errorf("Expected no affinity in the patch, got %v", patch.Spec.Template.Spec.Affinity)
+	}
+
+	procedure.Selector.Remove = true
+	patches, err := TargetApplyPatches(newApplyDeployment(), procedure)
+	if err != nil || patches != nil {
+		t.Errorf("Expected no apply patch when removing the selector, got %v, %v", patches, err)
+	}
+}
+
+// TestTargetApplyPatchesFieldManagers tests the affinity and the selector key are applied as separate field managers
+func TestTargetApplyPatchesFieldManagers(t *testing.T) {
+	procedure := k8smanagersv1.Procedure{
+		Affinity: k8smanagersv1.Affinity{
+			Key:     "agentpool",
+			Initial: "servicesblue",
+			Target:  "servicesgreen",
+		},
+		Selector: k8smanagersv1.Selector{
+			Key:     "pasx/node",
+			Initial: "miscblue",
+			Target:  "miscgreen",
+		},
+	}
+
+	deployment := newApplyDeployment()
+	deployment.Spec.Template.Spec.Affinity = &corev1.Affinity{NodeAffinity: CreateNodeAffinity("agentpool", "servicesblue")}
+
+	patches, err := TargetApplyPatches(deployment, procedure)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(patches) != 2 {
+		t.Fatalf("Expected an affinity and a selector patch, got %d patches", len(patches))
+	}
+
+	if patches[0].FieldManager != AffinityFieldManager {
+		t.Errorf("Expected the affinity to be applied as %s, got %s", AffinityFieldManager, patches[0].FieldManager)
+	}
+	affinityPatch := &appsv1.Deployment{}
+	if err := json.Unmarshal(patches[0].Data, affinityPatch); err != nil {
+		t.Fatalf("Expected a Deployment patch, got %v", err)
+	}
+	if affinityPatch.Spec.Template.Spec.NodeSelector != nil {
+		t.Errorf("Expected no node selector in the affinity patch, got %v", affinityPatch.Spec.Template.Spec.NodeSelector)
+	}
+
+	if patches[1].FieldManager != SelectorFieldManager("pasx/node") {
+		t.Errorf("Expected the selector to be applied as %s, got %s", SelectorFieldManager("pasx/node"), patches[1].FieldManager)
+	}
+	selectorPatch := &appsv1.Deployment{}
+	if err := json.Unmarshal(patches[1].Data, selectorPatch); err != nil {
+		t.Fatalf("Expected a Deployment patch, got %v", err)
+	}
+	if selectorPatch.Spec.Template.Spec.Affinity != nil {
+		t.Errorf("Expected no affinity in the selector patch, got %v", selectorPatch.Spec.Template.Spec.Affinity)
+	}
+
+	// A later procedure moving only the selector leaves the affinity to its own field manager
+	procedure.Affinity = k8smanagersv1.Affinity{}
+	if data := singleApplyPatch(t, deployment, procedure, SelectorFieldManager("pasx/node")); data == nil {
+		t.Errorf("Expected a selector patch")
+	}
+}
+
+// TestTargetApplyPatchesAffinityOnly tests an affinity-only procedure leaves an unrelated node selector alone
+func TestTargetApplyPatchesAffinityOnly(t *testing.T) {
+	procedure := k8smanagersv1.Procedure{
+		Affinity: k8smanagersv1.Affinity{
+			Key:     "agentpool",
+			Initial: "servicesblue",
+			Target:  "servicesgreen",
+		},
+		OnMismatch: k8smanagersv1.MismatchFail,
+	}
+
+	deployment := newApplyDeployment()
+	deployment.Spec.Template.Spec.NodeSelector = map[string]string{"kubernetes.io/os": "linux"}
+	deployment.Spec.Template.Spec.Affinity = &corev1.Affinity{NodeAffinity: CreateNodeAffinity("agentpool", "servicesblue")}
+
+	if err := CheckInitial(deployment, procedure, deployment.Name); err != nil {
+		t.Errorf("Expected the unrelated node selector to pass the initial check, got %v", err)
+	}
+
+	data := singleApplyPatch(t, deployment, procedure, AffinityFieldManager)
+
+	patch := &appsv1.Deployment{}
+	if err := json.Unmarshal(data, patch); err != nil {
+		t.Fatalf("Expected a Deployment patch, got %v", err)
+	}
+	if patch.Spec.Template.Spec.NodeSelector != nil {
+		t.Errorf("Expected no node selector in the patch, got %v", patch.Spec.Template.Spec.NodeSelector)
+	}
+	if values := getAffinityValues(patch.Spec.Template.Spec.Affinity.NodeAffinity, "agentpool"); len(values) != 1 || values[0] != "servicesgreen" {
+		t.Errorf("Expected agentpool In servicesgreen in the patch, got %v", values)
+	}
+
+	// Once moved, a second run has nothing to do
+	deployment.Spec.Template.Spec.Affinity = &corev1.Affinity{NodeAffinity: CreateNodeAffinity("agentpool", "servicesgreen")}
+	if !IsOnTarget(deployment, procedure) {
+		t.Errorf("Expected the moved deployment to be on target")
+	}
+}
+
+// TestTargetApplyPatchesCronJob tests the TargetApplyPatches function rewrites the job template of a CronJob
+func TestTargetApplyPatchesCronJob(t *testing.T) {
+	procedure := k8smanagersv1.Procedure{
+		Selector: k8smanagersv1.Selector{
+			Key:     "pasx/node",
+			Initial: "miscblue",
+			Target:  "miscgreen",
+		},
+	}
+
+	cronjob := &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-cronjob",
+			Namespace: "default",
+		},
+		Spec: batchv1.CronJobSpec{
+			JobTemplate: batchv1.JobTemplateSpec{
+				Spec: batchv1.JobSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							NodeSelector: map[string]string{"pasx/node": "miscblue"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	data := singleApplyPatch(t, cronjob, procedure, SelectorFieldManager("pasx/node"))
+
+	patch := &batchv1.CronJob{}
+	if err := json.Unmarshal(data, patch); err != nil {
+		t.Fatalf("Expected a CronJob patch, got %v", err)
+	}
+
+	if patch.APIVersion != "batch/v1" || patch.Kind != "CronJob" {
+		t.Errorf("Expected batch/v1 CronJob, got %s %s", patch.APIVersion, patch.Kind)
+	}
+
+	nodeSelector := patch.Spec.JobTemplate.Spec.Template.Spec.NodeSelector
+	if len(nodeSelector) != 1 || nodeSelector["pasx/node"] != "miscgreen" {
+		t.Errorf("Expected only pasx/node=miscgreen in the patch, got %v", nodeSelector)
+	}
+}
+
+// Helper function to get the only apply patch of the procedure, checking the field manager it is sent as
+func singleApplyPatch(t *testing.T, resource interface{}, procedure k8smanagersv1.Procedure, fieldManager string) []byte {
+	t.Helper()
+
+	patches, err := TargetApplyPatches(resource, procedure)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(patches) != 1 {
+		t.Fatalf("Expected a single apply patch, got %d", len(patches))
+	}
+	if patches[0].FieldManager != fieldManager {
+		t.Errorf("Expected the patch to be applied as %s, got %s", fieldManager, patches[0].FieldManager)
+	}
+	return patches[0].Data
+}
+
+// TestRemoveSelectorPatch tests the RemoveSelectorPatch function
+func TestRemoveSelectorPatch(t *testing.T) {
+	procedure := k8smanagersv1.Procedure{
+		Selector: k8smanagersv1.Selector{
+			Key:    "pasx/node",
+			Remove: true,
+		},
+	}
+
+	data, err := RemoveSelectorPatch(newApplyDeployment(), procedure)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	want := `{"spec":{"template":{"spec":{"nodeSelector":{"pasx/node":null}}}}}`
+	if string(data) != want {
+		t.Errorf("Expected %s, got %s", want, data)
+	}
+
+	procedure.Selector.Key = "missing"
+	data, err = RemoveSelectorPatch(newApplyDeployment(), procedure)
+	if err != nil || data != nil {
+		t.Errorf("Expected no patch for a missing key, got %s, %v", data, err)
+	}
+}
+
+// TestRestoreSelectorPatch tests the RestoreSelectorPatch function
+func TestRestoreSelectorPatch(t *testing.T) {
+	procedure := k8smanagersv1.Procedure{
+		Selector: k8smanagersv1.Selector{
+			Key:     "pasx/pool",
+			Initial: "miscblue",
+			Remove:  true,
+		},
+	}
+
+	data, err := RestoreSelectorPatch(newApplyDeployment(), procedure)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	want := `{"spec":{"template":{"spec":{"nodeSelector":{"pasx/pool":"miscblue"}}}}}`
+	if string(data) != want {
+		t.Errorf("Expected %s, got %s", want, data)
+	}
+
+	procedure.Selector.Key = "pasx/node"
+	data, err = RestoreSelectorPatch(newApplyDeployment(), procedure)
+	if err != nil || data != nil {
+		t.Errorf("Expected no patch for a key that is still present, got %s, %v", data, err)
+	}
+}
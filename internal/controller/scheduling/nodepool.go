@@ -0,0 +1,156 @@
+package scheduling
+
+import (
+	"errors"
+	k8smanagersv1 "greyridge.com/workloadManager/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ErrInitialMismatch is returned when a workload is not on the procedure's Initial value and
+// the procedure does not allow it to continue
+var ErrInitialMismatch = errors.New("resource is not on the initial node pool")
+
+// NodePool returns the node pool the resource is currently scheduled to, read from the
+// procedure's affinity key and then from its selector key. An empty string is returned
+// when neither is present on the pod template.
+func NodePool(resource interface{}, procedure k8smanagersv1.Procedure) string {
+	podSpec := getPodSpec(resource)
+	if podSpec == nil {
+		return ""
+	}
+
+	if procedure.Affinity.Key != "" && hasPodSpecNodeAffinity(podSpec) {
+		values := getAffinityValues(podSpec.Affinity.NodeAffinity, procedure.Affinity.Key)
+		if len(values) > 0 {
+			return values[0]
+		}
+	}
+
+	if procedure.Selector.Key != "" {
+		if val, exists := podSpec.NodeSelector[procedure.Selector.Key]; exists {
+			return val
+		}
+	}
+
+	return ""
+}
+
+// IsOnTarget checks if the resource already carries the procedure's target affinity and
+// selector, in which case there is nothing to update. A part of the procedure without a key
+// is not checked.
+func IsOnTarget(resource interface{}, procedure k8smanagersv1.Procedure) bool {
+	podSpec := getPodSpec(resource)
+	if podSpec == nil {
+		return false
+	}
+
+	matched := false
+
+	if procedure.Affinity.Key != "" && hasPodSpecNodeAffinity(podSpec) {
+		values := getAffinityValues(podSpec.Affinity.NodeAffinity, procedure.Affinity.Key)
+		if len(values) == 0 {
+			return false
+		}
+		for _, value := range values {
+			if value != procedure.Affinity.Target {
+				return false
+			}
+		}
+		matched = true
+	}
+
+	if procedure.Selector.Key == "" {
+		// Nothing to check on the node selector
+	} else if procedure.Selector.Remove {
+		if _, exists := podSpec.NodeSelector[procedure.Selector.Key]; exists {
+			return false
+		}
+		matched = true
+	} else if hasNodeSelector(podSpec.NodeSelector) {
+		val, exists := podSpec.NodeSelector[procedure.Selector.Key]
+		if !exists || val != procedure.Selector.Target {
+			return false
+		}
+		matched = true
+	}
+
+	return matched
+}
+
+// IsOnInitial checks if the resource carries the procedure's Initial affinity expression or node
+// selector entry. The matching is the same as CheckNodeAffinity and CheckNodeSelector.
+func IsOnInitial(resource interface{}, procedure k8smanagersv1.Procedure) bool {
+	podSpec := getPodSpec(resource)
+	if podSpec == nil {
+		return false
+	}
+
+	// Any mismatch has to be reported rather than logged
+	procedure.OnMismatch = k8smanagersv1.MismatchFail
+
+	if procedure.Affinity.Key != "" && hasPodSpecNodeAffinity(podSpec) {
+		if CheckNodeAffinity(podSpec.Affinity.NodeAffinity, procedure, "") == nil {
+			return true
+		}
+	}
+	if procedure.Selector.Key != "" && hasNodeSelector(podSpec.NodeSelector) {
+		if CheckNodeSelector(podSpec.NodeSelector, procedure, "") == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckInitial checks the resource's affinity and node selector against the procedure's
+// Initial values, honouring the procedure's OnMismatch policy. A part of the procedure without
+// a key is not checked.
+func CheckInitial(resource interface{}, procedure k8smanagersv1.Procedure, wlName string) error {
+	podSpec := getPodSpec(resource)
+	if podSpec == nil {
+		return nil
+	}
+
+	if procedure.Affinity.Key != "" && hasPodSpecNodeAffinity(podSpec) {
+		if err := CheckNodeAffinity(podSpec.Affinity.NodeAffinity, procedure, wlName); err != nil {
+			return err
+		}
+	}
+	if procedure.Selector.Key != "" && hasNodeSelector(podSpec.NodeSelector) {
+		return CheckNodeSelector(podSpec.NodeSelector, procedure, wlName)
+	}
+	return nil
+}
+
+// InitialMismatch returns the mismatch between the resource's affinity and node selector and the
+// procedure's Initial values whatever its OnMismatch policy, nil when there is none
+func InitialMismatch(resource interface{}, procedure k8smanagersv1.Procedure) error {
+	procedure.OnMismatch = k8smanagersv1.MismatchFail
+	return CheckInitial(resource, procedure, "")
+}
+
+// Helper function to check if a mismatch should only be logged
+func isWarnOnMismatch(procedure k8smanagersv1.Procedure) bool {
+	return procedure.OnMismatch == "" || procedure.OnMismatch == k8smanagersv1.MismatchWarn
+}
+
+// Helper function to get the pod spec from the resource template
+func getPodSpec(resource interface{}) *corev1.PodSpec {
+	switch obj := resource.(type) {
+	case *appsv1.Deployment:
+		return &obj.Spec.Template.Spec
+	case *appsv1.StatefulSet:
+		return &obj.Spec.Template.Spec
+	case *appsv1.DaemonSet:
+		return &obj.Spec.Template.Spec
+	case *batchv1.CronJob:
+		return &obj.Spec.JobTemplate.Spec.Template.Spec
+	case *batchv1.Job:
+		return &obj.Spec.Template.Spec
+	case *UnstructuredWorkload:
+		return obj.podSpec()
+	default:
+		return nil
+	}
+}
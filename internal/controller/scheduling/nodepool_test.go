@@ -0,0 +1,271 @@
+package scheduling
+
+import (
+	"errors"
+	"testing"
+
+	k8smanagersv1 "greyridge.com/workloadManager/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// TestNodePool tests the NodePool function
+func TestNodePool(t *testing.T) {
+	affinityDeployment := &appsv1.Deployment{
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Affinity: &corev1.Affinity{
+						NodeAffinity: CreateNodeAffinity("agentpool", "servicesblue"),
+					},
+				},
+			},
+		},
+	}
+	selectorStatefulSet := &appsv1.StatefulSet{
+		Spec: appsv1.StatefulSetSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					NodeSelector: map[string]string{
+						"pasx/node": "miscgreen",
+					},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		resource  interface{}
+		procedure k8smanagersv1.Procedure
+		want      string
+	}{
+		{
+			name:     "Deployment with matching affinity key",
+			resource: affinityDeployment,
+			procedure: k8smanagersv1.Procedure{
+				Affinity: k8smanagersv1.Affinity{Key: "agentpool"},
+			},
+			want: "servicesblue",
+		},
+		{
+			name:     "Deployment without matching affinity key",
+			resource: affinityDeployment,
+			procedure: k8smanagersv1.Procedure{
+				Affinity: k8smanagersv1.Affinity{Key: "pool"},
+			},
+			want: "",
+		},
+		{
+			name:     "StatefulSet with matching selector key",
+			resource: selectorStatefulSet,
+			procedure: k8smanagersv1.Procedure{
+				Selector: k8smanagersv1.Selector{Key: "pasx/node"},
+			},
+			want: "miscgreen",
+		},
+		{
+			name:     "StatefulSet with affinity-only procedure",
+			resource: selectorStatefulSet,
+			procedure: k8smanagersv1.Procedure{
+				Affinity: k8smanagersv1.Affinity{Key: "agentpool"},
+			},
+			want: "",
+		},
+		{
+			name:      "Invalid resource type",
+			resource:  &struct{}{},
+			procedure: k8smanagersv1.Procedure{},
+			want:      "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NodePool(tt.resource, tt.procedure); got != tt.want {
+				t.Errorf("NodePool() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestIsOnTarget tests the IsOnTarget function
+func TestIsOnTarget(t *testing.T) {
+	procedure := k8smanagersv1.Procedure{
+		Affinity: k8smanagersv1.Affinity{
+			Key:     "agentpool",
+			Initial: "servicesblue",
+			Target:  "servicesgreen",
+		},
+		Selector: k8smanagersv1.Selector{
+			Key:     "pasx/node",
+			Initial: "miscblue",
+			Target:  "miscgreen",
+		},
+	}
+
+	newDeployment := func(affinity *corev1.NodeAffinity, nodeSelector map[string]string) *appsv1.Deployment {
+		deployment := &appsv1.Deployment{}
+		if affinity != nil {
+			deployment.Spec.Template.Spec.Affinity = &corev1.Affinity{NodeAffinity: affinity}
+		}
+		deployment.Spec.Template.Spec.NodeSelector = nodeSelector
+		return deployment
+	}
+
+	tests := []struct {
+		name     string
+		resource interface{}
+		want     bool
+	}{
+		{
+			name:     "Affinity already on target",
+			resource: newDeployment(CreateNodeAffinity("agentpool", "servicesgreen"), nil),
+			want:     true,
+		},
+		{
+			name:     "Affinity still on initial",
+			resource: newDeployment(CreateNodeAffinity("agentpool", "servicesblue"), nil),
+			want:     false,
+		},
+		{
+			name:     "Selector already on target",
+			resource: newDeployment(nil, map[string]string{"pasx/node": "miscgreen"}),
+			want:     true,
+		},
+		{
+			name:     "Selector on target but affinity on initial",
+			resource: newDeployment(CreateNodeAffinity("agentpool", "servicesblue"), map[string]string{"pasx/node": "miscgreen"}),
+			want:     false,
+		},
+		{
+			name:     "Neither affinity nor selector",
+			resource: newDeployment(nil, nil),
+			want:     false,
+		},
+	}
+
+	// A selector-only procedure ignores an unrelated required affinity
+	selectorProcedure := procedure
+	selectorProcedure.Affinity = k8smanagersv1.Affinity{}
+	if !IsOnTarget(newDeployment(CreateNodeAffinity("kubernetes.io/arch", "amd64"), map[string]string{"pasx/node": "miscgreen"}), selectorProcedure) {
+		t.Errorf("IsOnTarget() = false, want true for a selector-only procedure with an unrelated affinity")
+	}
+
+	removeProcedure := procedure
+	removeProcedure.Selector.Remove = true
+	if IsOnTarget(newDeployment(nil, map[string]string{"pasx/node": "miscblue"}), removeProcedure) {
+		t.Errorf("IsOnTarget() = true, want false while the selector key is present")
+	}
+	if !IsOnTarget(newDeployment(nil, map[string]string{"kubernetes.io/os": "linux"}), removeProcedure) {
+		t.Errorf("IsOnTarget() = false, want true once the selector key is removed")
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsOnTarget(tt.resource, procedure); got != tt.want {
+				t.Errorf("IsOnTarget() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestIsOnInitial tests the IsOnInitial function
+func TestIsOnInitial(t *testing.T) {
+	procedure := k8smanagersv1.Procedure{
+		Affinity: k8smanagersv1.Affinity{
+			Key:     "agentpool",
+			Initial: "servicesblue",
+			Target:  "servicesgreen",
+		},
+		Selector: k8smanagersv1.Selector{
+			Key:     "pasx/node",
+			Initial: "miscblue",
+			Target:  "miscgreen",
+		},
+	}
+
+	newDeployment := func(affinity *corev1.NodeAffinity, nodeSelector map[string]string) *appsv1.Deployment {
+		deployment := &appsv1.Deployment{}
+		if affinity != nil {
+			deployment.Spec.Template.Spec.Affinity = &corev1.Affinity{NodeAffinity: affinity}
+		}
+		deployment.Spec.Template.Spec.NodeSelector = nodeSelector
+		return deployment
+	}
+
+	tests := []struct {
+		name     string
+		resource interface{}
+		want     bool
+	}{
+		{
+			name:     "Affinity on initial",
+			resource: newDeployment(CreateNodeAffinity("agentpool", "servicesblue"), nil),
+			want:     true,
+		},
+		{
+			name:     "Selector on initial",
+			resource: newDeployment(nil, map[string]string{"pasx/node": "miscblue"}),
+			want:     true,
+		},
+		{
+			name:     "Affinity on target",
+			resource: newDeployment(CreateNodeAffinity("agentpool", "servicesgreen"), nil),
+			want:     false,
+		},
+		{
+			name:     "Selector on another key",
+			resource: newDeployment(nil, map[string]string{"kubernetes.io/os": "linux"}),
+			want:     false,
+		},
+		{
+			name:     "Neither affinity nor selector",
+			resource: newDeployment(nil, nil),
+			want:     false,
+		},
+		{
+			name:     "Invalid resource type",
+			resource: &struct{}{},
+			want:     false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsOnInitial(tt.resource, procedure); got != tt.want {
+				t.Errorf("IsOnInitial() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestInitialMismatch tests the InitialMismatch function
+func TestInitialMismatch(t *testing.T) {
+	procedure := k8smanagersv1.Procedure{
+		Selector: k8smanagersv1.Selector{
+			Key:     "pasx/node",
+			Initial: "miscblue",
+			Target:  "miscgreen",
+		},
+		OnMismatch: k8smanagersv1.MismatchWarn,
+	}
+
+	onInitial := &appsv1.Deployment{}
+	onInitial.Spec.Template.Spec.NodeSelector = map[string]string{"pasx/node": "miscblue"}
+
+	if err := InitialMismatch(onInitial, procedure); err != nil {
+		t.Errorf("InitialMismatch() error = %v, want nil", err)
+	}
+
+	elsewhere := &appsv1.Deployment{}
+	elsewhere.Spec.Template.Spec.NodeSelector = map[string]string{"pasx/node": "miscred"}
+
+	// The warn policy only changes how the caller reacts, the mismatch is still reported
+	if err := InitialMismatch(elsewhere, procedure); !errors.Is(err, ErrInitialMismatch) {
+		t.Errorf("InitialMismatch() error = %v, want %v", err, ErrInitialMismatch)
+	}
+	if err := CheckInitial(elsewhere, procedure, "test"); err != nil {
+		t.Errorf("CheckInitial() error = %v, want nil", err)
+	}
+}
@@ -1,9 +1,10 @@
 package scheduling
 
 import (
+	"fmt"
 	k8smanagersv1 "greyridge.com/workloadManager/api/v1"
 	appsv1 "k8s.io/api/apps/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
@@ -14,30 +15,45 @@ func HasSelector(resource interface{}) bool {
 		return hasDeploymentSelector(obj)
 	case *appsv1.StatefulSet:
 		return hasStatefulSetSelector(obj)
+	case *appsv1.DaemonSet:
+		return hasDaemonSetSelector(obj)
+	case *batchv1.CronJob:
+		return hasCronJobSelector(obj)
+	case *batchv1.Job:
+		return hasJobSelector(obj)
+	case *UnstructuredWorkload:
+		podSpec := obj.podSpec()
+		return podSpec != nil && hasNodeSelector(podSpec.NodeSelector)
 	default:
 		return false
 	}
 }
 
-func CheckNodeSelector(selector *metav1.LabelSelector, procedure k8smanagersv1.Procedure, wlName string) error {
+// CheckNodeSelector checks the node selector carries the procedure's Initial value. A mismatch is
+// logged when the procedure's OnMismatch policy is warn, otherwise ErrInitialMismatch is returned.
+func CheckNodeSelector(nodeSelector map[string]string, procedure k8smanagersv1.Procedure, wlName string) error {
 
 	l := log.Log
 
-	if selector == nil {
+	if nodeSelector == nil {
 		return nil
 	}
 
 	checkOk := false
 
-	if val, exists := selector.MatchLabels[procedure.Selector.Key]; exists {
+	if val, exists := nodeSelector[procedure.Selector.Key]; exists {
 		if val == procedure.Selector.Initial {
 			checkOk = true
 		}
 	}
 
 	if checkOk == false {
-		l.Info("resource does not have the expected node selector", "workload name", wlName, "affinity key", procedure.Selector.Key, "expected value", procedure.Selector.Initial)
-		l.Info("Continuing...")
+		if isWarnOnMismatch(procedure) {
+			l.Info("resource does not have the expected node selector", "workload name", wlName, "affinity key", procedure.Selector.Key, "expected value", procedure.Selector.Initial)
+			l.Info("Continuing...")
+			return nil
+		}
+		return fmt.Errorf("%w: node selector %s is not %s", ErrInitialMismatch, procedure.Selector.Key, procedure.Selector.Initial)
 	}
 	return nil
 }
@@ -48,6 +64,33 @@ func CreateNodeSelector(key, value string) map[string]string {
 	}
 }
 
+// UpdateNodeSelector returns a copy of the node selector with key set to value, keeping every other key.
+// An empty key leaves the node selector as it is.
+func UpdateNodeSelector(nodeSelector map[string]string, key, value string) map[string]string {
+	if key == "" {
+		return RemoveNodeSelector(nodeSelector, key)
+	}
+
+	updated := CreateNodeSelector(key, value)
+	for k, v := range nodeSelector {
+		if k != key {
+			updated[k] = v
+		}
+	}
+	return updated
+}
+
+// RemoveNodeSelector returns a copy of the node selector without key, keeping every other key
+func RemoveNodeSelector(nodeSelector map[string]string, key string) map[string]string {
+	updated := map[string]string{}
+	for k, v := range nodeSelector {
+		if k != key {
+			updated[k] = v
+		}
+	}
+	return updated
+}
+
 // Helper function to check Selector for Deployment
 func hasDeploymentSelector(deployment *appsv1.Deployment) bool {
 	return hasNodeSelector(deployment.Spec.Template.Spec.NodeSelector)
@@ -58,6 +101,21 @@ func hasStatefulSetSelector(statefulset *appsv1.StatefulSet) bool {
 	return hasNodeSelector(statefulset.Spec.Template.Spec.NodeSelector)
 }
 
+// Helper function to check Selector for DaemonSet
+func hasDaemonSetSelector(daemonset *appsv1.DaemonSet) bool {
+	return hasNodeSelector(daemonset.Spec.Template.Spec.NodeSelector)
+}
+
+// Helper function to check Selector for CronJob
+func hasCronJobSelector(cronjob *batchv1.CronJob) bool {
+	return hasNodeSelector(cronjob.Spec.JobTemplate.Spec.Template.Spec.NodeSelector)
+}
+
+// Helper function to check Selector for Job
+func hasJobSelector(job *batchv1.Job) bool {
+	return hasNodeSelector(job.Spec.Template.Spec.NodeSelector)
+}
+
 func hasNodeSelector(nodeSelector map[string]string) bool {
 	if len(nodeSelector) > 0 {
 		return true
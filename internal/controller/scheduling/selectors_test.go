@@ -1,12 +1,13 @@
 package scheduling
 
 import (
+	"errors"
 	"testing"
 
 	k8smanagersv1 "greyridge.com/workloadManager/api/v1"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // TestHasSelector tests the HasSelector function
@@ -41,6 +42,55 @@ func TestHasSelector(t *testing.T) {
 		t.Errorf("Expected statefulset to have a selector")
 	}
 
+	daemonSet := &appsv1.DaemonSet{
+		Spec: appsv1.DaemonSetSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					NodeSelector: map[string]string{
+						"disktype": "ssd",
+					},
+				},
+			},
+		},
+	}
+	if !HasSelector(daemonSet) {
+		t.Errorf("Expected daemonset to have a selector")
+	}
+
+	cronJob := &batchv1.CronJob{
+		Spec: batchv1.CronJobSpec{
+			JobTemplate: batchv1.JobTemplateSpec{
+				Spec: batchv1.JobSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							NodeSelector: map[string]string{
+								"disktype": "ssd",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	if !HasSelector(cronJob) {
+		t.Errorf("Expected cronjob to have a selector")
+	}
+
+	job := &batchv1.Job{
+		Spec: batchv1.JobSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					NodeSelector: map[string]string{
+						"disktype": "ssd",
+					},
+				},
+			},
+		},
+	}
+	if !HasSelector(job) {
+		t.Errorf("Expected job to have a selector")
+	}
+
 	otherResource := "non-k8s-resource"
 	if HasSelector(otherResource) {
 		t.Errorf("Expected non-k8s resource to not have a selector")
@@ -49,10 +99,8 @@ func TestHasSelector(t *testing.T) {
 
 // TestCheckNodeSelector tests the CheckNodeSelector function
 func TestCheckNodeSelector(t *testing.T) {
-	selector := &metav1.LabelSelector{
-		MatchLabels: map[string]string{
-			"disktype": "ssd",
-		},
+	selector := map[string]string{
+		"disktype": "ssd",
 	}
 	procedure := k8smanagersv1.Procedure{
 		Selector: k8smanagersv1.Selector{
@@ -70,6 +118,12 @@ func TestCheckNodeSelector(t *testing.T) {
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
+
+	procedure.OnMismatch = k8smanagersv1.MismatchFail
+	err = CheckNodeSelector(selector, procedure, "test-workload")
+	if !errors.Is(err, ErrInitialMismatch) {
+		t.Errorf("Expected ErrInitialMismatch, got %v", err)
+	}
 }
 
 // TestCreateNodeSelector tests the CreateNodeSelector function
@@ -82,6 +136,45 @@ func TestCreateNodeSelector(t *testing.T) {
 	}
 }
 
+// TestUpdateNodeSelector tests the UpdateNodeSelector function
+func TestUpdateNodeSelector(t *testing.T) {
+	nodeSelector := map[string]string{
+		"pasx/node":        "miscblue",
+		"kubernetes.io/os": "linux",
+	}
+	updated := UpdateNodeSelector(nodeSelector, "pasx/node", "miscgreen")
+	if updated["pasx/node"] != "miscgreen" {
+		t.Errorf("Expected pasx/node to be miscgreen, got %s", updated["pasx/node"])
+	}
+	if updated["kubernetes.io/os"] != "linux" {
+		t.Errorf("Expected kubernetes.io/os to be kept, got %v", updated)
+	}
+	if nodeSelector["pasx/node"] != "miscblue" {
+		t.Errorf("Expected original nodeSelector to be unchanged, got %v", nodeSelector)
+	}
+
+	// An affinity-only procedure has no selector key and must not touch unrelated keys
+	unchanged := UpdateNodeSelector(map[string]string{"kubernetes.io/os": "linux"}, "", "")
+	if len(unchanged) != 1 || unchanged["kubernetes.io/os"] != "linux" {
+		t.Errorf("Expected nodeSelector with empty key to be unchanged, got %v", unchanged)
+	}
+}
+
+// TestRemoveNodeSelector tests the RemoveNodeSelector function
+func TestRemoveNodeSelector(t *testing.T) {
+	nodeSelector := map[string]string{
+		"pasx/node":        "miscblue",
+		"kubernetes.io/os": "linux",
+	}
+	updated := RemoveNodeSelector(nodeSelector, "pasx/node")
+	if _, exists := updated["pasx/node"]; exists {
+		t.Errorf("Expected pasx/node to be removed, got %v", updated)
+	}
+	if updated["kubernetes.io/os"] != "linux" {
+		t.Errorf("Expected kubernetes.io/os to be kept, got %v", updated)
+	}
+}
+
 // TestHasDeploymentSelector tests the hasDeploymentSelector helper function
 func TestHasDeploymentSelector(t *testing.T) {
 	deployment := &appsv1.Deployment{
@@ -118,6 +211,24 @@ func TestHasStatefulSetSelector(t *testing.T) {
 	}
 }
 
+// TestHasDaemonSetSelector tests the hasDaemonSetSelector helper function
+func TestHasDaemonSetSelector(t *testing.T) {
+	daemonSet := &appsv1.DaemonSet{
+		Spec: appsv1.DaemonSetSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					NodeSelector: map[string]string{
+						"disktype": "ssd",
+					},
+				},
+			},
+		},
+	}
+	if !hasDaemonSetSelector(daemonSet) {
+		t.Errorf("Expected daemonset to have a selector")
+	}
+}
+
 // TestHasNodeSelector tests the hasNodeSelector helper function
 func TestHasNodeSelector(t *testing.T) {
 	nodeSelector := map[string]string{
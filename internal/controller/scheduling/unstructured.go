@@ -0,0 +1,60 @@
+package scheduling
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// DefaultPodTemplatePath is used when a custom workload does not name the path to its pod template
+const DefaultPodTemplatePath = "spec.template"
+
+// UnstructuredWorkload is a workload of any kind that embeds a pod template at PodTemplatePath
+type UnstructuredWorkload struct {
+	*unstructured.Unstructured
+
+	PodTemplatePath []string
+}
+
+// NewUnstructuredWorkload wraps obj with the pod template path, given as a dot separated path
+// such as spec.template
+func NewUnstructuredWorkload(obj *unstructured.Unstructured, podTemplatePath string) *UnstructuredWorkload {
+	return &UnstructuredWorkload{
+		Unstructured:    obj,
+		PodTemplatePath: ParsePodTemplatePath(podTemplatePath),
+	}
+}
+
+// ParsePodTemplatePath splits a dot separated path into its fields. The JSONPath forms
+// .spec.template and {.spec.template} are accepted too.
+func ParsePodTemplatePath(path string) []string {
+	path = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(path), "{"), "}")
+	path = strings.TrimPrefix(path, ".")
+	if path == "" {
+		path = DefaultPodTemplatePath
+	}
+	return strings.Split(path, ".")
+}
+
+// Helper function to get the pod spec path of the workload
+func (w *UnstructuredWorkload) podSpecPath() []string {
+	path := make([]string, 0, len(w.PodTemplatePath)+1)
+	path = append(path, w.PodTemplatePath...)
+	return append(path, "spec")
+}
+
+// Helper function to read a copy of the pod spec of the workload
+func (w *UnstructuredWorkload) podSpec() *corev1.PodSpec {
+	object, found, err := unstructured.NestedMap(w.Object, w.podSpecPath()...)
+	if err != nil || !found {
+		return nil
+	}
+
+	podSpec := &corev1.PodSpec{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(object, podSpec); err != nil {
+		return nil
+	}
+	return podSpec
+}
@@ -0,0 +1,101 @@
+package scheduling
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	k8smanagersv1 "greyridge.com/workloadManager/api/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func newRollout() *UnstructuredWorkload {
+	return NewUnstructuredWorkload(&unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "argoproj.io/v1alpha1",
+			"kind":       "Rollout",
+			"metadata": map[string]interface{}{
+				"name":      "test-rollout",
+				"namespace": "default",
+			},
+			"spec": map[string]interface{}{
+				"template": map[string]interface{}{
+					"spec": map[string]interface{}{
+						"nodeSelector": map[string]interface{}{
+							"pasx/node": "miscblue",
+						},
+						"containers": []interface{}{
+							map[string]interface{}{"name": "app", "image": "busybox"},
+						},
+					},
+				},
+			},
+		},
+	}, "spec.template")
+}
+
+// TestParsePodTemplatePath tests the ParsePodTemplatePath function
+func TestParsePodTemplatePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{path: "spec.template", want: []string{"spec", "template"}},
+		{path: ".spec.workload.template", want: []string{"spec", "workload", "template"}},
+		{path: "{.spec.template}", want: []string{"spec", "template"}},
+		{path: "", want: []string{"spec", "template"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := ParsePodTemplatePath(tt.path); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParsePodTemplatePath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestUnstructuredWorkload tests the scheduling helpers on a custom workload kind
+func TestUnstructuredWorkload(t *testing.T) {
+	procedure := k8smanagersv1.Procedure{
+		Selector: k8smanagersv1.Selector{
+			Key:     "pasx/node",
+			Initial: "miscblue",
+			Target:  "miscgreen",
+		},
+	}
+
+	rollout := newRollout()
+	if !HasSelector(rollout) {
+		t.Errorf("Expected rollout to have a selector")
+	}
+	if HasAffinity(rollout) {
+		t.Errorf("Expected rollout to not have an affinity")
+	}
+	if pool := NodePool(rollout, procedure); pool != "miscblue" {
+		t.Errorf("Expected node pool miscblue, got %s", pool)
+	}
+	if err := CheckInitial(rollout, procedure, rollout.GetName()); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	data := singleApplyPatch(t, rollout, procedure, SelectorFieldManager("pasx/node"))
+
+	patch := &unstructured.Unstructured{}
+	if err := json.Unmarshal(data, &patch.Object); err != nil {
+		t.Fatalf("Expected a Rollout patch, got %v", err)
+	}
+	if patch.GetAPIVersion() != "argoproj.io/v1alpha1" || patch.GetKind() != "Rollout" || patch.GetName() != "test-rollout" {
+		t.Errorf("Expected argoproj.io/v1alpha1 Rollout test-rollout, got %s %s %s", patch.GetAPIVersion(), patch.GetKind(), patch.GetName())
+	}
+
+	nodeSelector, _, _ := unstructured.NestedStringMap(patch.Object, "spec", "template", "spec", "nodeSelector")
+	if len(nodeSelector) != 1 || nodeSelector["pasx/node"] != "miscgreen" {
+		t.Errorf("Expected only pasx/node=miscgreen in the patch, got %v", nodeSelector)
+	}
+
+	missing := NewUnstructuredWorkload(rollout.Unstructured, "spec.missing")
+	if HasSelector(missing) || HasAffinity(missing) {
+		t.Errorf("Expected no scheduling for a missing pod template")
+	}
+}
@@ -0,0 +1,261 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	k8smanagersv1 "greyridge.com/workloadManager/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sync"
+)
+
+// defaultKubeconfigKey is read when the Secret reference does not name a key
+const defaultKubeconfigKey = "kubeconfig"
+
+// kubeconfigSecretName returns the namespace and name of the kubeconfig Secret of the WorkloadManager
+func kubeconfigSecretName(wlManager *k8smanagersv1.WorkloadManager) types.NamespacedName {
+	ref := wlManager.Spec.KubeconfigSecretRef
+	if ref == nil {
+		return types.NamespacedName{}
+	}
+
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = wlManager.Namespace
+	}
+	return types.NamespacedName{Namespace: namespace, Name: ref.Name}
+}
+
+// getKubeconfigSecret fetches the kubeconfig Secret of the WorkloadManager and returns the
+// kubeconfig it holds
+func (r *WorkloadManagerReconciler) getKubeconfigSecret(ctx context.Context, wlManager *k8smanagersv1.WorkloadManager) (*corev1.Secret, []byte, error) {
+	ref := wlManager.Spec.KubeconfigSecretRef
+	if ref == nil || ref.Name == "" {
+		return nil, nil, fmt.Errorf("kubeconfigSecretRef is mandatory when using %s", k8smanagersv1.KubeconfigSecret)
+	}
+
+	if err := checkSecretNamespace(wlManager, "kubeconfigSecretRef", ref.Namespace); err != nil {
+		return nil, nil, err
+	}
+
+	key := ref.Key
+	if key == "" {
+		key = defaultKubeconfigKey
+	}
+
+	name := kubeconfigSecretName(wlManager)
+	secret := &corev1.Secret{}
+	if err := r.reader().Get(ctx, name, secret); err != nil {
+		return nil, nil, fmt.Errorf("reading kubeconfig Secret %s: %w", name, err)
+	}
+
+	kubeconfig, ok := secret.Data[key]
+	if !ok || len(kubeconfig) == 0 {
+		return nil, nil, fmt.Errorf("kubeconfig Secret %s has no key %q", name, key)
+	}
+	return secret, kubeconfig, nil
+}
+
+// kubeconfigSecretConfig builds the config for the target cluster in memory from the kubeconfig
+// Secret of the WorkloadManager. Nothing is written to disk.
+func (r *WorkloadManagerReconciler) kubeconfigSecretConfig(ctx context.Context, wlManager *k8smanagersv1.WorkloadManager) (*rest.Config, error) {
+	l := log.Log
+
+	_, kubeconfig, err := r.getKubeconfigSecret(ctx, wlManager)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+	if err != nil {
+		l.Error(err, "Cannot load kubeconfig from Secret", "secret", kubeconfigSecretName(wlManager))
+		return nil, err
+	}
+	return config, nil
+}
+
+// credentialVersion returns the version of the credentials the WorkloadManager logs in with, so that
+// cached clients are built again when they change. Only credentials held in a Secret have a version.
+// Under the manager the Secret is watched, so its version is read from the watch and a rotated Secret
+// triggers a reconcile; otherwise it is read at every step.
+func (r *WorkloadManagerReconciler) credentialVersion(ctx context.Context, wlManager *k8smanagersv1.WorkloadManager) (string, error) {
+	owner := types.NamespacedName{Namespace: wlManager.Namespace, Name: wlManager.Name}
+
+	if wlManager.Spec.SPNLoginType == k8smanagersv1.KubeconfigSecret {
+		return r.secretVersion(owner, kubeconfigSecretName(wlManager), func() (*corev1.Secret, error) {
+			secret, _, err := r.getKubeconfigSecret(ctx, wlManager)
+			return secret, err
+		})
+	}
+
+	if wlManager.Spec.SPNLoginType == k8smanagersv1.AzureIdentity &&
+		azureIdentityOf(wlManager).Method == k8smanagersv1.ClientCertificate {
+		return r.secretVersion(owner, certificateSecretName(wlManager), func() (*corev1.Secret, error) {
+			return r.getCertificateSecret(ctx, wlManager)
+		})
+	}
+
+	if r.secrets != nil {
+		r.secrets.release(owner)
+	}
+	return "", nil
+}
+
+// Helper function to get the resource version of the Secret named name from its watch once it has
+// synced. Until then, and when Secrets are not watched, the Secret is read and checked through get.
+func (r *WorkloadManagerReconciler) secretVersion(owner types.NamespacedName, name types.NamespacedName, get func() (*corev1.Secret, error)) (string, error) {
+	// Only Secrets in the namespace of the WorkloadManager are watched, get reports the others
+	if r.secrets != nil && name.Name != "" && name.Namespace == owner.Namespace {
+		if version, ok := r.secrets.version(owner, name); ok {
+			return version, nil
+		}
+	}
+
+	secret, err := get()
+	if err != nil {
+		return "", err
+	}
+	return secret.ResourceVersion, nil
+}
+
+// secretWatcher follows the Secrets the WorkloadManagers log in with and asks for the WorkloadManagers
+// using one to be reconciled when it changes. Each Secret has its own informer, limited to its
+// namespace and name, that only lists and watches its metadata: the data of the Secret is never cached.
+type secretWatcher struct {
+	client metadata.Interface
+	events chan<- event.GenericEvent
+
+	mu sync.Mutex
+	// watchers holds the WorkloadManagers logging in with each Secret
+	watchers map[types.NamespacedName]map[types.NamespacedName]struct{}
+	// informers holds the informer of each Secret logged in with
+	informers map[types.NamespacedName]*secretInformer
+}
+
+// secretInformer follows the metadata of a single Secret
+type secretInformer struct {
+	informer cache.SharedIndexInformer
+	stopCh   chan struct{}
+}
+
+// newSecretWatcher returns a watcher for the Secrets of the cluster reached through client
+func newSecretWatcher(client metadata.Interface, events chan<- event.GenericEvent) *secretWatcher {
+	return &secretWatcher{
+		client:    client,
+		events:    events,
+		watchers:  map[types.NamespacedName]map[types.NamespacedName]struct{}{},
+		informers: map[types.NamespacedName]*secretInformer{},
+	}
+}
+
+// version records that the WorkloadManager logs in with the Secret, starting its informer if needed,
+// and returns the resource version of the Secret. It is not ok until the informer has synced.
+func (w *secretWatcher) version(owner types.NamespacedName, name types.NamespacedName) (string, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.releaseLocked(owner)
+	if w.watchers[name] == nil {
+		w.watchers[name] = map[types.NamespacedName]struct{}{}
+	}
+	w.watchers[name][owner] = struct{}{}
+	w.pruneLocked()
+
+	informer := w.informers[name]
+	if informer == nil {
+		informer = w.newSecretInformer(name)
+		w.informers[name] = informer
+	}
+	if !informer.informer.HasSynced() {
+		return "", false
+	}
+
+	object, exists, err := informer.informer.GetStore().GetByKey(name.String())
+	if err != nil || !exists {
+		return "", false
+	}
+	return object.(metav1.Object).GetResourceVersion(), true
+}
+
+// release stops following the Secrets of the WorkloadManager
+func (w *secretWatcher) release(owner types.NamespacedName) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.releaseLocked(owner)
+	w.pruneLocked()
+}
+
+// Helper function to drop the WorkloadManager from every watched Secret, with mu held
+func (w *secretWatcher) releaseLocked(owner types.NamespacedName) {
+	for name, owners := range w.watchers {
+		delete(owners, owner)
+		if len(owners) == 0 {
+			delete(w.watchers, name)
+		}
+	}
+}
+
+// Helper function to stop the informers of the Secrets no WorkloadManager logs in with, with mu held
+func (w *secretWatcher) pruneLocked() {
+	for name, informer := range w.informers {
+		if _, ok := w.watchers[name]; !ok {
+			close(informer.stopCh)
+			delete(w.informers, name)
+		}
+	}
+}
+
+// Helper function to start the informer of the Secret, with mu held
+func (w *secretWatcher) newSecretInformer(name types.NamespacedName) *secretInformer {
+	informer := metadatainformer.NewFilteredMetadataInformer(w.client, corev1.SchemeGroupVersion.WithResource("secrets"),
+		name.Namespace, 0, cache.Indexers{}, func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name.Name).String()
+		}).Informer()
+
+	// The Secret listed when the informer starts is the one the clients were built with
+	_, _ = informer.AddEventHandler(cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(_ interface{}, isInInitialList bool) {
+			if !isInInitialList {
+				w.notify(name)
+			}
+		},
+		UpdateFunc: func(_, _ interface{}) { w.notify(name) },
+		DeleteFunc: func(interface{}) { w.notify(name) },
+	})
+
+	secretInformer := &secretInformer{informer: informer, stopCh: make(chan struct{})}
+	go informer.Run(secretInformer.stopCh)
+	return secretInformer
+}
+
+// notify queues a reconcile for every WorkloadManager logging in with the Secret
+func (w *secretWatcher) notify(name types.NamespacedName) {
+	w.mu.Lock()
+	owners := make([]types.NamespacedName, 0, len(w.watchers[name]))
+	for owner := range w.watchers[name] {
+		owners = append(owners, owner)
+	}
+	w.mu.Unlock()
+
+	enqueue(w.events, owners)
+}
+
+// checkSecretNamespace checks that a Secret reference stays in the namespace of the WorkloadManager.
+// The controller reads and watches Secrets in any namespace, a WorkloadManager must not use it to
+// read others.
+func checkSecretNamespace(wlManager *k8smanagersv1.WorkloadManager, field string, namespace string) error {
+	if namespace != "" && namespace != wlManager.Namespace {
+		return fmt.Errorf("%s.namespace must be the namespace of the WorkloadManager %q, not %q", field, wlManager.Namespace, namespace)
+	}
+	return nil
+}
@@ -0,0 +1,559 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	k8smanagersv1 "greyridge.com/workloadManager/api/v1"
+	"greyridge.com/workloadManager/internal/controller/monitoring"
+	"greyridge.com/workloadManager/internal/controller/scheduling"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"strings"
+	"time"
+)
+
+// minRequeue keeps a workload whose timeout has already passed from being checked in a tight loop
+const minRequeue = time.Second
+
+// step advances the run by one step. Workloads waiting to become ready are checked once, the
+// workloads and procedures whose turn has come are started and the progress is written to the
+// status, so that a restarted controller carries on from the same point. Nothing blocks: the
+// result asks for the next step when the earliest readiness check is due.
+func (r *WorkloadManagerReconciler) step(ctx context.Context, wlManager *k8smanagersv1.WorkloadManager) (ctrl.Result, error) {
+	l := log.Log
+
+	cluster, err := r.targetCluster(ctx, wlManager)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	defer cluster.watch(wlManager)
+
+	deps, err := procedureDependencies(wlManager.Spec.Procedures)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var next time.Duration
+	for i, procedure := range wlManager.Spec.Procedures {
+		procStatus := procedureStatus(wlManager, i)
+
+		if procStatus.Phase == k8smanagersv1.PhasePending {
+			// A failure only stops the procedures depending on it, through their dependencies in turn
+			if blocked := blockedDependencies(wlManager, deps[i]); len(blocked) > 0 {
+				procStatus.Message = "Not started, dependencies did not succeed: " + strings.Join(blocked, ", ")
+				setProcedurePhase(wlManager, i, k8smanagersv1.PhaseFailed)
+				continue
+			}
+			if !dependenciesDone(wlManager, deps[i]) {
+				continue
+			}
+
+			if wlManager.Spec.TestMode {
+				l.Info("TEST MODE: The controller will try to set the affinity", "workloads", procedure.Workloads, "key", procedure.Affinity.Key, "from", procedure.Affinity.Initial, "to", procedure.Affinity.Target)
+				procStatus.Message = "Test mode, no workloads were changed"
+				setProcedurePhase(wlManager, i, k8smanagersv1.PhaseSkipped)
+				continue
+			}
+
+			procStatus.Message = ""
+			setProcedurePhase(wlManager, i, k8smanagersv1.PhaseApplying)
+		}
+
+		if !isActive(procStatus.Phase) {
+			continue
+		}
+
+		if wait := r.stepProcedure(ctx, cluster, wlManager, i); wait > 0 && (next == 0 || wait < next) {
+			next = wait
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if ctx.Err() != nil {
+		// Shutting down, record where the run got to so the next leader can pick it up
+		r.updateStatus(ctx, wlManager)
+		l.Info("Step interrupted, progress recorded", "phase", wlManager.Status.Phase, "procedure", wlManager.Status.CurrentProcedure)
+		return ctrl.Result{}, ctx.Err()
+	}
+
+	active := false
+	for _, procStatus := range wlManager.Status.Procedures {
+		if isActive(procStatus.Phase) {
+			active = true
+		}
+	}
+
+	// Procedures that do not depend on a failed one run on, the run fails once every procedure is over
+	if !active && allFinished(wlManager) {
+		if err := procedureErrors(wlManager); err != nil {
+			return ctrl.Result{}, err
+		}
+		r.markComplete(ctx, wlManager)
+		return ctrl.Result{}, nil
+	}
+
+	setPendingMessages(wlManager, deps)
+	r.updateStatus(ctx, wlManager)
+
+	if next == 0 {
+		// A procedure finished and its dependents can start straight away
+		return ctrl.Result{Requeue: true}, nil
+	}
+	l.V(1).Info("Waiting for the next step", "after", next)
+	return ctrl.Result{RequeueAfter: next}, nil
+}
+
+// stepProcedure advances the workloads of the procedure at index: those being moved are checked,
+// pending ones are started up to the concurrency limit, and the procedure's outcome is recorded
+// once every workload has one. The time until the next readiness check is returned, or zero when
+// the procedure has finished.
+func (r *WorkloadManagerReconciler) stepProcedure(ctx context.Context, cluster *targetCluster, wlManager *k8smanagersv1.WorkloadManager, index int) time.Duration {
+	procedure := wlManager.Spec.Procedures[index]
+	if procedure.Timeout == 0 {
+		procedure.Timeout = 600
+	}
+	wlType := string(procedure.Type)
+	procStatus := procedureStatus(wlManager, index)
+
+	var next time.Duration
+	inFlight := 0
+	failed := false
+
+	track := func(wlStatus *k8smanagersv1.WorkloadStatus, wait time.Duration) {
+		if isActive(wlStatus.Phase) {
+			inFlight++
+			if next == 0 || wait < next {
+				next = wait
+			}
+		}
+		if wlStatus.Phase == k8smanagersv1.PhaseFailed || wlStatus.Phase == k8smanagersv1.PhaseRolledBack {
+			failed = true
+		}
+	}
+
+	for i := range procStatus.Workloads {
+		if ctx.Err() != nil {
+			return 0
+		}
+		wlStatus := &procStatus.Workloads[i]
+
+		// Workloads found through the namespace selector live outside the procedure's namespace
+		wlProcedure := procedure
+		wlProcedure.Namespace = wlStatus.Namespace
+
+		var wait time.Duration
+		if wlStatus.Phase == k8smanagersv1.PhaseApplying {
+			// The controller stopped while the workload was being patched
+			wait = r.applyWorkload(ctx, cluster, wlManager, wlStatus, wlProcedure, wlType)
+		} else if wlStatus.Phase == k8smanagersv1.PhaseWaitingReady || wlStatus.Phase == k8smanagersv1.PhaseRollingBack {
+			wait = r.checkWorkload(ctx, cluster, wlManager, wlStatus, wlProcedure, wlType)
+		}
+		track(wlStatus, wait)
+	}
+
+	limit := maxConcurrent(wlManager, index)
+	for i := range procStatus.Workloads {
+		if failed || inFlight >= limit || ctx.Err() != nil {
+			break
+		}
+
+		wlStatus := &procStatus.Workloads[i]
+		if wlStatus.Phase != k8smanagersv1.PhasePending {
+			continue
+		}
+
+		wlProcedure := procedure
+		wlProcedure.Namespace = wlStatus.Namespace
+
+		track(wlStatus, r.applyWorkload(ctx, cluster, wlManager, wlStatus, wlProcedure, wlType))
+	}
+
+	if ctx.Err() != nil {
+		return 0
+	}
+
+	if inFlight > 0 {
+		if procStatus.Phase != k8smanagersv1.PhaseWaitingReady {
+			setProcedurePhase(wlManager, index, k8smanagersv1.PhaseWaitingReady)
+		}
+		return next
+	}
+
+	phase := k8smanagersv1.PhaseSucceeded
+	for _, wlStatus := range procStatus.Workloads {
+		if wlStatus.Phase == k8smanagersv1.PhaseTimedOut {
+			phase = k8smanagersv1.PhaseTimedOut
+		}
+	}
+	if failed {
+		phase = k8smanagersv1.PhaseFailed
+	}
+	setProcedurePhase(wlManager, index, phase)
+	return 0
+}
+
+// applyWorkload moves a single workload to the procedure's Target. The workload is recorded as
+// Applying before it is patched, so that after a restart a workload found on the Target while
+// still Applying is waited for rather than taken as already moved.
+func (r *WorkloadManagerReconciler) applyWorkload(ctx context.Context, cluster *targetCluster, wlManager *k8smanagersv1.WorkloadManager, wlStatus *k8smanagersv1.WorkloadStatus, procedure k8smanagersv1.Procedure, wlType string) time.Duration {
+	l := log.Log
+
+	workload := wlStatus.Name
+	resuming := wlStatus.Phase == k8smanagersv1.PhaseApplying
+	if !resuming {
+		startWorkload(wlStatus)
+		r.updateStatus(ctx, wlManager)
+	}
+
+	resource, err := r.getWorkload(ctx, cluster, procedure, wlType, workload)
+	if ctx.Err() != nil {
+		return 0
+	}
+	if err != nil {
+		l.Error(err, "Workload not found", "type", wlType, "namespace", procedure.Namespace, "name", workload)
+		finishWorkload(wlStatus, k8smanagersv1.PhaseFailed, workloadError(wlType, procedure.Namespace, workload, err))
+		return 0
+	}
+
+	if scheduling.IsOnTarget(resource, procedure) {
+		wlStatus.NodePool = scheduling.NodePool(resource, procedure)
+		if resuming {
+			l.Info("Workload was moved before the controller restarted", "type", wlType, "namespace", procedure.Namespace, "name", workload)
+			wlStatus.Phase = k8smanagersv1.PhaseWaitingReady
+			return nextCheck(cluster, wlStatus.StartTime.Time, procedure, wlType)
+		}
+		l.Info("Workload is already on the target, skipping", "type", wlType, "namespace", procedure.Namespace, "name", workload)
+		finishWorkload(wlStatus, k8smanagersv1.PhaseSucceeded, nil)
+		return 0
+	}
+
+	if err = scheduling.CheckInitial(resource, procedure, workload); err != nil {
+		err = workloadError(wlType, procedure.Namespace, workload, err)
+		if procedure.OnMismatch == k8smanagersv1.MismatchSkip {
+			l.Info("Workload is not on the initial node pool, skipping", "type", wlType, "namespace", procedure.Namespace, "name", workload)
+			finishWorkload(wlStatus, k8smanagersv1.PhaseSkipped, err)
+			return 0
+		}
+		l.Error(err, "Workload is not on the initial node pool")
+		finishWorkload(wlStatus, k8smanagersv1.PhaseFailed, err)
+		return 0
+	}
+
+	l.V(1).Info("Updating scheduling", "type", wlType, "name", workload, "affinity", procedure.Affinity, "selector", procedure.Selector)
+	resource, err = r.patchScheduling(ctx, cluster, resource, procedure, wlType)
+	if ctx.Err() != nil {
+		// Left as Applying, the workload is looked at again after the restart
+		return 0
+	}
+	if err != nil {
+		err = workloadError(wlType, procedure.Namespace, workload, err)
+		l.Error(err, "Error updating workload")
+		finishWorkload(wlStatus, k8smanagersv1.PhaseFailed, err)
+		return 0
+	}
+
+	wlStatus.NodePool = scheduling.NodePool(resource, procedure)
+	wlStatus.Phase = k8smanagersv1.PhaseWaitingReady
+	r.updateStatus(ctx, wlManager)
+
+	l.Info("Starting to wait", "name", workload, "timeout", time.Duration(procedure.Timeout)*time.Second)
+	return nextCheck(cluster, wlStatus.StartTime.Time, procedure, wlType)
+}
+
+// checkWorkload checks once whether a workload that was moved, or rolled back, is ready. A
+// workload that is not ready by the procedure timeout is rolled back when the procedure asks
+// for it, otherwise it times out.
+func (r *WorkloadManagerReconciler) checkWorkload(ctx context.Context, cluster *targetCluster, wlManager *k8smanagersv1.WorkloadManager, wlStatus *k8smanagersv1.WorkloadStatus, procedure k8smanagersv1.Procedure, wlType string) time.Duration {
+	l := log.Log
+
+	workload := wlStatus.Name
+	rollingBack := wlStatus.Phase == k8smanagersv1.PhaseRollingBack
+	original := procedure
+
+	since := wlStatus.StartTime.Time
+	if rollingBack {
+		procedure = rollbackProcedure(procedure)
+		since = wlStatus.RollbackTime.Time
+	}
+
+	settle, _ := readinessTiming(cluster, procedure, wlType)
+	if time.Now().Before(since.Add(settle)) {
+		return nextCheck(cluster, since, procedure, wlType)
+	}
+
+	resource, err := r.readWorkload(ctx, cluster, procedure, wlType, workload)
+	if err == nil && rollingBack && !scheduling.IsOnTarget(resource, procedure) {
+		// The controller stopped before the rollback was sent
+		l.Info("Resuming rollback", "type", wlType, "namespace", procedure.Namespace, "name", workload)
+		if err = r.sendRollback(ctx, cluster, wlStatus, original, wlType); err == nil {
+			r.updateStatus(ctx, wlManager)
+			return nextCheck(cluster, since, procedure, wlType)
+		}
+	}
+
+	if err != nil {
+		l.Error(err, "Could not monitor", "type", wlType, "namespace", procedure.Namespace, "name", workload)
+	} else if r.isReady(ctx, cluster, resource, procedure, wlType, since) {
+		if rollingBack {
+			l.Info("Workload rolled back", "type", wlType, "namespace", procedure.Namespace, "name", workload)
+			finishWorkload(wlStatus, k8smanagersv1.PhaseRolledBack, fmt.Errorf("%s, rolled back to %s", wlStatus.LastError, wlStatus.NodePool))
+			return 0
+		}
+		finishWorkload(wlStatus, k8smanagersv1.PhaseSucceeded, nil)
+		return 0
+	}
+
+	if ctx.Err() != nil {
+		return 0
+	}
+
+	if time.Now().Before(since.Add(time.Duration(procedure.Timeout) * time.Second)) {
+		return nextCheck(cluster, since, procedure, wlType)
+	}
+
+	if rollingBack {
+		err := fmt.Errorf("%s, rollback failed: not ready within %ds after rollback", wlStatus.LastError, procedure.Timeout)
+		l.Error(err, "Rollback failed")
+		finishWorkload(wlStatus, k8smanagersv1.PhaseFailed, err)
+		return 0
+	}
+
+	timeoutErr := workloadError(wlType, procedure.Namespace, workload, fmt.Errorf("not ready within %ds", procedure.Timeout))
+	if !procedure.RollbackOnFailure {
+		finishWorkload(wlStatus, k8smanagersv1.PhaseTimedOut, timeoutErr)
+		return 0
+	}
+	return r.rollbackWorkload(ctx, cluster, wlManager, wlStatus, procedure, wlType, timeoutErr)
+}
+
+// rollbackWorkload sends the workload back to the procedure's Initial affinity and selector. The
+// rollback is recorded before the workload is patched and checkWorkload then waits for it.
+func (r *WorkloadManagerReconciler) rollbackWorkload(ctx context.Context, cluster *targetCluster, wlManager *k8smanagersv1.WorkloadManager, wlStatus *k8smanagersv1.WorkloadStatus, original k8smanagersv1.Procedure, wlType string, timeoutErr error) time.Duration {
+	l := log.Log
+
+	procedure := rollbackProcedure(original)
+
+	l.Info("Rolling back workload", "type", wlType, "namespace", procedure.Namespace, "name", wlStatus.Name)
+	now := metav1.Now()
+	wlStatus.Phase = k8smanagersv1.PhaseRollingBack
+	wlStatus.RollbackTime = &now
+	wlStatus.LastError = timeoutErr.Error()
+	r.updateStatus(ctx, wlManager)
+
+	if err := r.sendRollback(ctx, cluster, wlStatus, original, wlType); err != nil {
+		if ctx.Err() != nil {
+			// Left as RollingBack, the rollback is sent again after the restart
+			return 0
+		}
+		err = fmt.Errorf("%w, rollback failed: %w", timeoutErr, err)
+		l.Error(err, "Rollback failed")
+		finishWorkload(wlStatus, k8smanagersv1.PhaseFailed, err)
+		return 0
+	}
+	r.updateStatus(ctx, wlManager)
+
+	return nextCheck(cluster, now.Time, procedure, wlType)
+}
+
+// sendRollback patches the workload back to the original procedure's Initial affinity and selector,
+// restoring a selector key the procedure removed
+func (r *WorkloadManagerReconciler) sendRollback(ctx context.Context, cluster *targetCluster, wlStatus *k8smanagersv1.WorkloadStatus, original k8smanagersv1.Procedure, wlType string) error {
+	procedure := rollbackProcedure(original)
+	workload := wlStatus.Name
+
+	resource, err := r.getWorkload(ctx, cluster, procedure, wlType, workload)
+	if err != nil {
+		return err
+	}
+
+	resource, err = r.patchScheduling(ctx, cluster, resource, procedure, wlType)
+	if err != nil {
+		return err
+	}
+
+	restorePatch, err := scheduling.RestoreSelectorPatch(resource, original)
+	if err != nil {
+		return err
+	}
+	if restorePatch != nil {
+		resource, err = r.patchWorkload(ctx, cluster, procedure, wlType, workload, types.MergePatchType, restorePatch,
+			metav1.PatchOptions{FieldManager: scheduling.FieldManager})
+		if err != nil {
+			return err
+		}
+	}
+
+	wlStatus.NodePool = scheduling.NodePool(resource, procedure)
+	return nil
+}
+
+// readWorkload reads a workload being waited on from its informers once they have synced. Until
+// then it is read from the API server, and its informers are started from what was read.
+func (r *WorkloadManagerReconciler) readWorkload(ctx context.Context, cluster *targetCluster, procedure k8smanagersv1.Procedure, wlType string, name string) (interface{}, error) {
+	if reader := cluster.reader(wlType, procedure.Namespace, name); reader != nil {
+		return monitoring.GetWorkload(ctx, reader, wlType, procedure.Namespace, name)
+	}
+
+	resource, err := r.getWorkload(ctx, cluster, procedure, wlType, name)
+	if err == nil {
+		cluster.watchWorkload(resource, wlType)
+	}
+	return resource, err
+}
+
+// isReady runs a single readiness check of the workload, moved at since
+func (r *WorkloadManagerReconciler) isReady(ctx context.Context, cluster *targetCluster, resource interface{}, procedure k8smanagersv1.Procedure, wlType string, since time.Time) bool {
+	l := log.Log
+
+	ctx = context.WithValue(ctx, "namespace", procedure.Namespace)
+	ctx = context.WithValue(ctx, "clientset", cluster.clientset)
+	ctx = context.WithValue(ctx, "resource", resource)
+	ctx = context.WithValue(ctx, "startTime", since)
+	if object, ok := resource.(metav1.Object); ok {
+		if reader := cluster.reader(wlType, procedure.Namespace, object.GetName()); reader != nil {
+			ctx = context.WithValue(ctx, "reader", reader)
+		}
+	}
+
+	if wlType == k8smanagersv1.Custom {
+		resourceClient, err := r.customResource(cluster, procedure)
+		if err != nil {
+			l.Error(err, "Could not monitor")
+			return false
+		}
+		ctx = context.WithValue(ctx, "dynamic", resourceClient)
+	}
+
+	return monitoring.IsResourceReady(ctx, wlType)
+}
+
+// readinessTiming returns how long to leave a moved workload before its first readiness check and
+// how often to check it after that. Watched workloads are checked as they change, the interval
+// only covers missed events.
+func readinessTiming(cluster *targetCluster, procedure k8smanagersv1.Procedure, wlType string) (time.Duration, time.Duration) {
+	interval := 10 * time.Second
+	if wlType == k8smanagersv1.StatefulSet {
+		interval = 30 * time.Second
+	}
+	if cluster.watcher != nil && wlType != k8smanagersv1.Custom {
+		interval = watchedInterval
+	}
+
+	if wlType == k8smanagersv1.StatefulSet {
+		return 30 * time.Second, interval // Pause to allow affinity injection to take
+	}
+	if procedure.Timeout > 10 {
+		return 10 * time.Second, interval // Pause to allow affinity injection to take
+	}
+	return 0, interval
+}
+
+// nextCheck returns how long to wait before checking a workload moved at since again. The check
+// is never later than the procedure timeout.
+func nextCheck(cluster *targetCluster, since time.Time, procedure k8smanagersv1.Procedure, wlType string) time.Duration {
+	settle, interval := readinessTiming(cluster, procedure, wlType)
+
+	now := time.Now()
+	if due := since.Add(settle); now.Before(due) {
+		return due.Sub(now)
+	}
+
+	wait := interval
+	if remaining := since.Add(time.Duration(procedure.Timeout) * time.Second).Sub(now); remaining < wait {
+		wait = remaining
+	}
+	if wait < minRequeue {
+		wait = minRequeue
+	}
+	return wait
+}
+
+// dependenciesDone checks that every procedure in deps has released the procedures waiting for it
+func dependenciesDone(wlManager *k8smanagersv1.WorkloadManager, deps []int) bool {
+	return len(pendingDependencies(wlManager, deps)) == 0
+}
+
+// pendingDependencies returns the names of the procedures in deps that have not released the
+// procedures waiting for them, see releasesDependents
+func pendingDependencies(wlManager *k8smanagersv1.WorkloadManager, deps []int) []string {
+	var waiting []string
+	for _, dep := range deps {
+		if !releasesDependents(procedureStatus(wlManager, dep).Phase) {
+			waiting = append(waiting, procedureName(wlManager.Spec.Procedures[dep], dep))
+		}
+	}
+	return waiting
+}
+
+// blockedDependencies returns the names and phases of the procedures in deps that have finished
+// without releasing the procedures waiting for them, which can then never start
+func blockedDependencies(wlManager *k8smanagersv1.WorkloadManager, deps []int) []string {
+	var blocked []string
+	for _, dep := range deps {
+		phase := procedureStatus(wlManager, dep).Phase
+		if isFinished(phase) && !releasesDependents(phase) {
+			blocked = append(blocked, fmt.Sprintf("%s (%s)", procedureName(wlManager.Spec.Procedures[dep], dep), phase))
+		}
+	}
+	return blocked
+}
+
+// releasesDependents checks if a procedure in phase lets the procedures waiting for it start. A
+// dependency has to succeed or be skipped, whether it comes from DependsOn or from list order.
+func releasesDependents(phase k8smanagersv1.ProcedurePhase) bool {
+	return phase == k8smanagersv1.PhaseSucceeded || phase == k8smanagersv1.PhaseSkipped
+}
+
+// allFinished checks if every procedure has reached its outcome
+func allFinished(wlManager *k8smanagersv1.WorkloadManager) bool {
+	for _, procStatus := range wlManager.Status.Procedures {
+		if !isFinished(procStatus.Phase) {
+			return false
+		}
+	}
+	return true
+}
+
+// procedureErrors returns the errors of the workloads of every failed procedure
+func procedureErrors(wlManager *k8smanagersv1.WorkloadManager) error {
+	var errs []error
+	for i, procStatus := range wlManager.Status.Procedures {
+		if procStatus.Phase != k8smanagersv1.PhaseFailed {
+			continue
+		}
+
+		var procErrs []error
+		for _, wlStatus := range procStatus.Workloads {
+			if (wlStatus.Phase == k8smanagersv1.PhaseFailed || wlStatus.Phase == k8smanagersv1.PhaseRolledBack) && wlStatus.LastError != "" {
+				procErrs = append(procErrs, errors.New(wlStatus.LastError))
+			}
+		}
+		if len(procErrs) == 0 && procStatus.Message != "" {
+			procErrs = append(procErrs, fmt.Errorf("procedure %q: %s", procedureName(wlManager.Spec.Procedures[i], i), procStatus.Message))
+		} else if len(procErrs) == 0 {
+			procErrs = append(procErrs, fmt.Errorf("procedure %q failed", procedureName(wlManager.Spec.Procedures[i], i)))
+		}
+		errs = append(errs, procErrs...)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// setPendingMessages explains why each procedure that has not started is still waiting
+func setPendingMessages(wlManager *k8smanagersv1.WorkloadManager, deps [][]int) {
+	for i := range wlManager.Spec.Procedures {
+		procStatus := procedureStatus(wlManager, i)
+		if procStatus.Phase != k8smanagersv1.PhasePending {
+			continue
+		}
+
+		if waiting := pendingDependencies(wlManager, deps[i]); len(waiting) > 0 {
+			procStatus.Message = "Waiting for " + strings.Join(waiting, ", ")
+		}
+	}
+}
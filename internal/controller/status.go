@@ -0,0 +1,240 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	k8smanagersv1 "greyridge.com/workloadManager/api/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"strings"
+	"time"
+)
+
+// statusWriteTimeout bounds the status write made after the reconcile has been cancelled
+const statusWriteTimeout = 10 * time.Second
+
+// initStatus resets the status so that every procedure and workload in the spec starts as Pending
+func initStatus(wlManager *k8smanagersv1.WorkloadManager) {
+	procedures := make([]k8smanagersv1.ProcedureStatus, 0, len(wlManager.Spec.Procedures))
+
+	for _, procedure := range wlManager.Spec.Procedures {
+		workloads := make([]k8smanagersv1.WorkloadStatus, 0, len(procedure.Workloads))
+		for _, workload := range procedure.Workloads {
+			workloads = append(workloads, k8smanagersv1.WorkloadStatus{
+				Name:      workload,
+				Namespace: procedure.Namespace,
+				Phase:     k8smanagersv1.PhasePending,
+			})
+		}
+
+		procedures = append(procedures, k8smanagersv1.ProcedureStatus{
+			Name:        procedure.Name,
+			Description: procedure.Description,
+			Type:        procedure.Type,
+			Namespace:   procedure.Namespace,
+			Phase:       k8smanagersv1.PhasePending,
+			Workloads:   workloads,
+		})
+	}
+
+	wlManager.Status.Procedures = procedures
+	wlManager.Status.Phase = k8smanagersv1.PhasePending
+	wlManager.Status.CurrentProcedure = ""
+	wlManager.Status.ObservedGeneration = wlManager.Generation
+	wlManager.Status.ObservedRerun = wlManager.Annotations[k8smanagersv1.RerunAnnotation]
+}
+
+// isCompleted checks if the procedures have already run to completion for the current
+// generation and no re-run has been requested through the annotation
+func isCompleted(wlManager *k8smanagersv1.WorkloadManager) bool {
+	if wlManager.Status.CompletedGeneration != wlManager.Generation {
+		return false
+	}
+
+	rerun := wlManager.Annotations[k8smanagersv1.RerunAnnotation]
+	return rerun == "" || rerun == wlManager.Status.LastRerun
+}
+
+// isInProgress checks if a run was started for the current generation and re-run request and
+// still has workloads to move or wait for, so it can be resumed where it left off
+func isInProgress(wlManager *k8smanagersv1.WorkloadManager) bool {
+	if wlManager.Status.ObservedGeneration != wlManager.Generation ||
+		wlManager.Status.ObservedRerun != wlManager.Annotations[k8smanagersv1.RerunAnnotation] {
+		return false
+	}
+	return isActive(wlManager.Status.Phase)
+}
+
+// isActive checks if a procedure or workload in phase is being moved or waited for
+func isActive(phase k8smanagersv1.ProcedurePhase) bool {
+	return phase == k8smanagersv1.PhaseApplying || phase == k8smanagersv1.PhaseWaitingReady ||
+		phase == k8smanagersv1.PhaseRollingBack
+}
+
+// isFinished checks if a procedure or workload in phase has reached its outcome
+func isFinished(phase k8smanagersv1.ProcedurePhase) bool {
+	return phase != k8smanagersv1.PhasePending && phase != k8smanagersv1.PhaseValidating && !isActive(phase)
+}
+
+// procedureName returns a human readable identifier for the procedure at index
+func procedureName(procedure k8smanagersv1.Procedure, index int) string {
+	if procedure.Name != "" {
+		return procedure.Name
+	}
+	if procedure.Description != "" {
+		return procedure.Description
+	}
+	return fmt.Sprintf("%d: %s/%s", index, procedure.Namespace, procedure.Type)
+}
+
+// setProcedurePhase moves the procedure at index to phase and makes it the current procedure.
+// The overall phase follows while the procedure is in progress; the outcome of the run is
+// recorded by markComplete or markFailed.
+func setProcedurePhase(wlManager *k8smanagersv1.WorkloadManager, index int, phase k8smanagersv1.ProcedurePhase) {
+	procedureStatus(wlManager, index).Phase = phase
+	if !isFinished(phase) {
+		wlManager.Status.Phase = phase
+	}
+	wlManager.Status.CurrentProcedure = procedureName(wlManager.Spec.Procedures[index], index)
+}
+
+// setCondition adds or updates a condition for the current generation of the WorkloadManager
+func setCondition(wlManager *k8smanagersv1.WorkloadManager, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&wlManager.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: wlManager.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// procedureStatus returns the status entry for the procedure at index
+func procedureStatus(wlManager *k8smanagersv1.WorkloadManager, index int) *k8smanagersv1.ProcedureStatus {
+	return &wlManager.Status.Procedures[index]
+}
+
+// workloadStatus returns the status entry for the named workload of the procedure at index
+func workloadStatus(wlManager *k8smanagersv1.WorkloadManager, index int, namespace string, name string) *k8smanagersv1.WorkloadStatus {
+	procStatus := procedureStatus(wlManager, index)
+
+	for i := range procStatus.Workloads {
+		if procStatus.Workloads[i].Namespace == namespace && procStatus.Workloads[i].Name == name {
+			return &procStatus.Workloads[i]
+		}
+	}
+
+	procStatus.Workloads = append(procStatus.Workloads, k8smanagersv1.WorkloadStatus{
+		Name:      name,
+		Namespace: namespace,
+		Phase:     k8smanagersv1.PhasePending,
+	})
+	return &procStatus.Workloads[len(procStatus.Workloads)-1]
+}
+
+// workloadRefs returns the namespace and name of every workload recorded for the procedure at index,
+// in the order they are moved
+func workloadRefs(wlManager *k8smanagersv1.WorkloadManager, index int) []types.NamespacedName {
+	procStatus := procedureStatus(wlManager, index)
+
+	refs := make([]types.NamespacedName, 0, len(procStatus.Workloads))
+	for _, wlStatus := range procStatus.Workloads {
+		refs = append(refs, types.NamespacedName{Namespace: wlStatus.Namespace, Name: wlStatus.Name})
+	}
+	return refs
+}
+
+// startWorkload marks the workload as being applied
+func startWorkload(wlStatus *k8smanagersv1.WorkloadStatus) {
+	now := metav1.Now()
+	wlStatus.Phase = k8smanagersv1.PhaseApplying
+	wlStatus.StartTime = &now
+	wlStatus.EndTime = nil
+	wlStatus.LastError = ""
+}
+
+// finishWorkload marks the workload as complete with the given phase
+func finishWorkload(wlStatus *k8smanagersv1.WorkloadStatus, phase k8smanagersv1.ProcedurePhase, err error) {
+	now := metav1.Now()
+	wlStatus.Phase = phase
+	wlStatus.EndTime = &now
+	if err != nil {
+		wlStatus.LastError = err.Error()
+	}
+}
+
+// updateStatus writes the in-memory status through the status subresource. Failures are
+// logged but do not interrupt the procedures. The status is still written once the reconcile
+// has been cancelled, so that the step in flight at shutdown is recorded for the next leader.
+func (r *WorkloadManagerReconciler) updateStatus(ctx context.Context, wlManager *k8smanagersv1.WorkloadManager) {
+	l := log.Log
+
+	if ctx.Err() != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.WithoutCancel(ctx), statusWriteTimeout)
+		defer cancel()
+	}
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest := &k8smanagersv1.WorkloadManager{}
+		if err := r.reader().Get(ctx, client.ObjectKeyFromObject(wlManager), latest); err != nil {
+			return err
+		}
+		latest.Status = wlManager.Status
+		return r.Status().Update(ctx, latest)
+	})
+	if err != nil {
+		l.Error(err, "Unable to update status", "namespace", wlManager.Namespace, "name", wlManager.Name)
+	}
+}
+
+// markFailed records that the procedures could not be completed
+func (r *WorkloadManagerReconciler) markFailed(ctx context.Context, wlManager *k8smanagersv1.WorkloadManager, reason string, err error) {
+	wlManager.Status.Phase = k8smanagersv1.PhaseFailed
+	setCondition(wlManager, k8smanagersv1.ConditionProgressing, metav1.ConditionFalse, reason, err.Error())
+	setCondition(wlManager, k8smanagersv1.ConditionDegraded, metav1.ConditionTrue, reason, err.Error())
+	setCondition(wlManager, k8smanagersv1.ConditionReady, metav1.ConditionFalse, reason, err.Error())
+	r.updateStatus(ctx, wlManager)
+}
+
+// failureReason returns the condition reason for the failed workloads: FieldConflict when a workload
+// was left alone because another field manager owns its scheduling fields, otherwise fallback
+func failureReason(wlManager *k8smanagersv1.WorkloadManager, fallback string) string {
+	for _, procStatus := range wlManager.Status.Procedures {
+		for _, wlStatus := range procStatus.Workloads {
+			if wlStatus.Phase == k8smanagersv1.PhaseFailed && strings.Contains(wlStatus.LastError, errFieldConflict.Error()+":") {
+				return "FieldConflict"
+			}
+		}
+	}
+	return fallback
+}
+
+// markComplete records that every procedure has been applied, noting any workloads that timed out
+func (r *WorkloadManagerReconciler) markComplete(ctx context.Context, wlManager *k8smanagersv1.WorkloadManager) {
+	wlManager.Status.Phase = k8smanagersv1.PhaseSucceeded
+	wlManager.Status.CurrentProcedure = ""
+	wlManager.Status.CompletedGeneration = wlManager.Generation
+	wlManager.Status.LastRerun = wlManager.Annotations[k8smanagersv1.RerunAnnotation]
+
+	for _, procStatus := range wlManager.Status.Procedures {
+		if procStatus.Phase == k8smanagersv1.PhaseTimedOut {
+			wlManager.Status.Phase = k8smanagersv1.PhaseTimedOut
+		}
+	}
+
+	setCondition(wlManager, k8smanagersv1.ConditionProgressing, metav1.ConditionFalse, "Complete", "All procedures have been applied")
+	if wlManager.Status.Phase == k8smanagersv1.PhaseTimedOut {
+		message := "One or more workloads were not ready before the procedure timeout"
+		setCondition(wlManager, k8smanagersv1.ConditionDegraded, metav1.ConditionTrue, "TimedOut", message)
+		setCondition(wlManager, k8smanagersv1.ConditionReady, metav1.ConditionFalse, "TimedOut", message)
+	} else {
+		setCondition(wlManager, k8smanagersv1.ConditionDegraded, metav1.ConditionFalse, "Complete", "All workloads are ready")
+		setCondition(wlManager, k8smanagersv1.ConditionReady, metav1.ConditionTrue, "Complete", "All workloads are ready")
+	}
+	r.updateStatus(ctx, wlManager)
+}
@@ -19,19 +19,27 @@ package controller
 import (
 	"context"
 	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"net/http"
 	"path/filepath"
 	"runtime"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
@@ -125,6 +133,85 @@ func newStatefulset() *appsv1.StatefulSet {
 	}
 }
 
+func newDaemonset() *appsv1.DaemonSet {
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-daemonset",
+			Namespace: "default",
+		},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": "agent"},
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{"app": "agent"},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:  "test-container3",
+							Image: "busybox",
+							Args:  []string{"/bin/sh", "-c", "sleep 3600"},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func newCronjob() *batchv1.CronJob {
+	return &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-cronjob",
+			Namespace: "default",
+		},
+		Spec: batchv1.CronJobSpec{
+			Schedule: "0 * * * *",
+			JobTemplate: batchv1.JobTemplateSpec{
+				Spec: batchv1.JobSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							RestartPolicy: corev1.RestartPolicyOnFailure,
+							Containers: []corev1.Container{
+								{
+									Name:  "test-container4",
+									Image: "busybox",
+									Args:  []string{"/bin/sh", "-c", "date"},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func newJob() *batchv1.Job {
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-job",
+			Namespace: "default",
+		},
+		Spec: batchv1.JobSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:  "test-container5",
+							Image: "busybox",
+							Args:  []string{"/bin/sh", "-c", "date"},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
 func newResource() *k8smanagersv1.WorkloadManager {
 	return &k8smanagersv1.WorkloadManager{
 		ObjectMeta: metav1.ObjectMeta{
@@ -135,13 +222,103 @@ func newResource() *k8smanagersv1.WorkloadManager {
 			SubscriptionID: "3e54eb54-946e-4ff4-a430-d7b190cd45cf",
 			ResourceGroup:  "node-upgrader",
 			ClusterName:    "lm-cluster",
-			SPNLoginType:   "azCli",
+			SPNLoginType:   k8smanagersv1.InCluster,
 			RetryOnError:   false,
 			TestMode:       false,
 		},
 	}
 }
 
+// newKubeconfigSecret returns a Secret holding a kubeconfig for the test environment
+func newKubeconfigSecret() *corev1.Secret {
+	kubeconfig := clientcmdapi.NewConfig()
+	kubeconfig.Clusters["envtest"] = &clientcmdapi.Cluster{
+		Server:                   cfg.Host,
+		CertificateAuthorityData: cfg.CAData,
+	}
+	kubeconfig.AuthInfos["envtest"] = &clientcmdapi.AuthInfo{
+		ClientCertificateData: cfg.CertData,
+		ClientKeyData:         cfg.KeyData,
+		Token:                 cfg.BearerToken,
+	}
+	kubeconfig.Contexts["envtest"] = &clientcmdapi.Context{Cluster: "envtest", AuthInfo: "envtest"}
+	kubeconfig.CurrentContext = "envtest"
+
+	data, err := clientcmd.Write(*kubeconfig)
+	Expect(err).NotTo(HaveOccurred())
+
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-kubeconfig",
+			Namespace: "default",
+		},
+		Data: map[string][]byte{"kubeconfig": data},
+	}
+}
+
+// fakeCredential hands out a fixed token in place of Microsoft Entra ID
+type fakeCredential struct {
+	token string
+}
+
+func (c fakeCredential) GetToken(_ context.Context, _ policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: c.token, ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+// staleClient returns a fixed WorkloadManager, as a cache that has not seen the latest status
+type staleClient struct {
+	client.Client
+	wlManager *k8smanagersv1.WorkloadManager
+}
+
+func (c staleClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	if wlManager, ok := obj.(*k8smanagersv1.WorkloadManager); ok {
+		c.wlManager.DeepCopyInto(wlManager)
+		return nil
+	}
+	return c.Client.Get(ctx, key, obj, opts...)
+}
+
+// blockingClient holds every Secret read until release is closed, as a slow login would
+type blockingClient struct {
+	client.Client
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c blockingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	if _, ok := obj.(*corev1.Secret); ok {
+		select {
+		case c.started <- struct{}{}:
+		default:
+		}
+		<-c.release
+	}
+	return c.Client.Get(ctx, key, obj, opts...)
+}
+
+// cancellingClient cancels the reconcile once the Secret has been read reads times, as a
+// WorkloadManager deleted or a controller shutting down in the middle of a login would
+type cancellingClient struct {
+	client.Client
+	reads  *int32
+	cancel context.CancelFunc
+}
+
+func (c cancellingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	if _, ok := obj.(*corev1.Secret); ok && atomic.AddInt32(c.reads, -1) == 0 {
+		c.cancel()
+	}
+	return c.Client.Get(ctx, key, obj, opts...)
+}
+
+// roundTripperFunc answers requests without a server
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
 func TestControllers(t *testing.T) {
 	RegisterFailHandler(Fail)
 
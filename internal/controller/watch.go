@@ -0,0 +1,344 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	k8smanagersv1 "greyridge.com/workloadManager/api/v1"
+	"greyridge.com/workloadManager/internal/controller/monitoring"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	k8sinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sync"
+	"time"
+)
+
+// watchedInterval is how often a watched workload is checked when no event has arrived for it.
+// Changes to the workload or its pods trigger a check straight away.
+const watchedInterval = 2 * time.Minute
+
+// workloadWatcher follows the workloads on a target cluster that are being moved and asks for the
+// WorkloadManagers moving them to be reconciled whenever one of them changes. Each workload has its
+// own informers, limited to its namespace, to its name and to the pods its selector picks, and its
+// readiness is read from them rather than from the API server. The server does the filtering, so
+// neither every pod of the namespace is cached nor a field index is needed to find the workload.
+type workloadWatcher struct {
+	clientset kubernetes.Interface
+	events    chan<- event.GenericEvent
+
+	mu sync.Mutex
+	// watchers holds the WorkloadManagers waiting on each workload, by workloadKey
+	watchers map[string]map[types.NamespacedName]struct{}
+	// informers holds the informers of each workload waited on, by workloadKey
+	informers map[string]*workloadInformers
+}
+
+// workloadInformers follow a single workload and the objects its readiness is decided from
+type workloadInformers struct {
+	listers monitoring.Listers
+	synced  []cache.InformerSynced
+	stopCh  chan struct{}
+}
+
+// newWorkloadWatcher returns a watcher for the target cluster reached through clientset. Informers
+// are only started for the workloads waited on, see watchWorkload.
+func newWorkloadWatcher(clientset kubernetes.Interface, events chan<- event.GenericEvent) *workloadWatcher {
+	return &workloadWatcher{
+		clientset: clientset,
+		events:    events,
+		watchers:  map[string]map[types.NamespacedName]struct{}{},
+		informers: map[string]*workloadInformers{},
+	}
+}
+
+// stop shuts the informers of every workload down
+func (w *workloadWatcher) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for key, informers := range w.informers {
+		close(informers.stopCh)
+		delete(w.informers, key)
+	}
+}
+
+// setWatched replaces the workloads the WorkloadManager is waiting on with those still being moved
+func (w *workloadWatcher) setWatched(wlManager *k8smanagersv1.WorkloadManager) {
+	owner := types.NamespacedName{Namespace: wlManager.Namespace, Name: wlManager.Name}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.releaseLocked(owner)
+
+	for _, procStatus := range wlManager.Status.Procedures {
+		for _, wlStatus := range procStatus.Workloads {
+			if !isActive(wlStatus.Phase) {
+				continue
+			}
+			key := workloadKey(string(procStatus.Type), wlStatus.Namespace, wlStatus.Name)
+			if w.watchers[key] == nil {
+				w.watchers[key] = map[types.NamespacedName]struct{}{}
+			}
+			w.watchers[key][owner] = struct{}{}
+		}
+	}
+
+	w.pruneLocked()
+}
+
+// adopt takes over the workloads waited on from the watcher of the clients being replaced. Their
+// WorkloadManagers are reconciled, so that the informers are started again on the new clients.
+func (w *workloadWatcher) adopt(old *workloadWatcher) {
+	old.mu.Lock()
+	watchers := make(map[string][]types.NamespacedName, len(old.watchers))
+	for key, owners := range old.watchers {
+		for owner := range owners {
+			watchers[key] = append(watchers[key], owner)
+		}
+	}
+	old.mu.Unlock()
+
+	w.mu.Lock()
+	adopted := map[types.NamespacedName]struct{}{}
+	for key, owners := range watchers {
+		if w.watchers[key] == nil {
+			w.watchers[key] = map[types.NamespacedName]struct{}{}
+		}
+		for _, owner := range owners {
+			w.watchers[key][owner] = struct{}{}
+			adopted[owner] = struct{}{}
+		}
+	}
+	w.mu.Unlock()
+
+	owners := make([]types.NamespacedName, 0, len(adopted))
+	for owner := range adopted {
+		owners = append(owners, owner)
+	}
+	enqueue(w.events, owners)
+}
+
+// release stops following the workloads of the WorkloadManager
+func (w *workloadWatcher) release(owner types.NamespacedName) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.releaseLocked(owner)
+	w.pruneLocked()
+}
+
+// Helper function to drop the WorkloadManager from every watched workload, with mu held
+func (w *workloadWatcher) releaseLocked(owner types.NamespacedName) {
+	for key, owners := range w.watchers {
+		delete(owners, owner)
+		if len(owners) == 0 {
+			delete(w.watchers, key)
+		}
+	}
+}
+
+// Helper function to stop the informers of the workloads no WorkloadManager waits on, with mu held
+func (w *workloadWatcher) pruneLocked() {
+	for key, informers := range w.informers {
+		if _, ok := w.watchers[key]; !ok {
+			close(informers.stopCh)
+			delete(w.informers, key)
+		}
+	}
+}
+
+// watchWorkload starts the informers of a workload waited on, read from the API server as resource
+func (w *workloadWatcher) watchWorkload(resource interface{}, wlType string) {
+	l := log.Log
+
+	object, ok := resource.(metav1.Object)
+	if !ok {
+		return
+	}
+	key := workloadKey(wlType, object.GetNamespace(), object.GetName())
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.watchers[key]; !ok || w.informers[key] != nil {
+		return
+	}
+
+	informers, err := w.newWorkloadInformers(key, resource, wlType)
+	if err != nil {
+		l.Error(err, "Cannot watch workload, it is polled instead", "type", wlType, "namespace", object.GetNamespace(), "name", object.GetName())
+		return
+	}
+	w.informers[key] = informers
+}
+
+// reader returns the reader of a workload waited on once its informers have synced, nil otherwise
+func (w *workloadWatcher) reader(wlType string, namespace string, name string) monitoring.Reader {
+	w.mu.Lock()
+	informers := w.informers[workloadKey(wlType, namespace, name)]
+	w.mu.Unlock()
+
+	if informers == nil {
+		return nil
+	}
+	for _, synced := range informers.synced {
+		if !synced() {
+			return nil
+		}
+	}
+	return informers.listers
+}
+
+// newWorkloadInformers starts the informers of the workload: the workload itself by name, the pods
+// picked by its selector and, for a CronJob, the Jobs and pods created from its templates
+func (w *workloadWatcher) newWorkloadInformers(key string, resource interface{}, wlType string) (*workloadInformers, error) {
+	object := resource.(metav1.Object)
+	namespace := object.GetNamespace()
+
+	informers := &workloadInformers{stopCh: make(chan struct{})}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { w.notify([]string{key}) },
+		UpdateFunc: func(_, _ interface{}) { w.notify([]string{key}) },
+		DeleteFunc: func(interface{}) { w.notify([]string{key}) },
+	}
+	add := func(informer cache.SharedIndexInformer) {
+		_, _ = informer.AddEventHandler(handler)
+		informers.synced = append(informers.synced, informer.HasSynced)
+	}
+
+	named := namespaceInformers(w.clientset, namespace, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", object.GetName()).String(),
+	})
+
+	var podSelector labels.Selector
+	var jobSelector labels.Selector
+
+	if wlType == k8smanagersv1.Deployment {
+		informer := named.Apps().V1().Deployments()
+		informers.listers.Deployments = informer.Lister()
+		add(informer.Informer())
+		podSelector = workloadSelector(resource.(*appsv1.Deployment).Spec.Selector)
+	} else if wlType == k8smanagersv1.StatefulSet {
+		informer := named.Apps().V1().StatefulSets()
+		informers.listers.StatefulSets = informer.Lister()
+		add(informer.Informer())
+		podSelector = workloadSelector(resource.(*appsv1.StatefulSet).Spec.Selector)
+	} else if wlType == k8smanagersv1.DaemonSet {
+		informer := named.Apps().V1().DaemonSets()
+		informers.listers.DaemonSets = informer.Lister()
+		add(informer.Informer())
+	} else if wlType == k8smanagersv1.Job {
+		informer := named.Batch().V1().Jobs()
+		informers.listers.Jobs = informer.Lister()
+		add(informer.Informer())
+		podSelector = workloadSelector(resource.(*batchv1.Job).Spec.Selector)
+	} else if wlType == k8smanagersv1.CronJob {
+		cronjob := resource.(*batchv1.CronJob)
+		informer := named.Batch().V1().CronJobs()
+		informers.listers.CronJobs = informer.Lister()
+		add(informer.Informer())
+
+		// The Jobs and their pods carry the labels of the templates, and the pods the name of their Job
+		jobSelector = labels.SelectorFromSet(cronjob.Spec.JobTemplate.Labels)
+		podSelector = labels.SelectorFromSet(cronjob.Spec.JobTemplate.Spec.Template.Labels)
+		if podSelector.Empty() {
+			requirement, err := labels.NewRequirement(batchv1.JobNameLabel, selection.Exists, nil)
+			if err != nil {
+				return nil, err
+			}
+			podSelector = labels.NewSelector().Add(*requirement)
+		}
+	} else {
+		return nil, fmt.Errorf("unsupported workload type %s", wlType)
+	}
+
+	if podSelector == nil && wlType != k8smanagersv1.DaemonSet {
+		return nil, errors.New("workload has no pod selector")
+	}
+
+	factories := []k8sinformers.SharedInformerFactory{named}
+	if podSelector != nil {
+		pods := namespaceInformers(w.clientset, namespace, metav1.ListOptions{LabelSelector: podSelector.String()})
+		informer := pods.Core().V1().Pods()
+		informers.listers.Pods = informer.Lister()
+		add(informer.Informer())
+		factories = append(factories, pods)
+	}
+	if jobSelector != nil {
+		jobs := namespaceInformers(w.clientset, namespace, metav1.ListOptions{LabelSelector: jobSelector.String()})
+		informer := jobs.Batch().V1().Jobs()
+		informers.listers.Jobs = informer.Lister()
+		add(informer.Informer())
+		factories = append(factories, jobs)
+	}
+
+	for _, factory := range factories {
+		factory.Start(informers.stopCh)
+	}
+	return informers, nil
+}
+
+// Helper function to get the informer factory for the objects of the namespace picked by options
+func namespaceInformers(clientset kubernetes.Interface, namespace string, options metav1.ListOptions) k8sinformers.SharedInformerFactory {
+	return k8sinformers.NewSharedInformerFactoryWithOptions(clientset, 0, k8sinformers.WithNamespace(namespace),
+		k8sinformers.WithTweakListOptions(func(listOptions *metav1.ListOptions) {
+			listOptions.FieldSelector = options.FieldSelector
+			listOptions.LabelSelector = options.LabelSelector
+		}))
+}
+
+// Helper function to convert the pod selector of a workload, nil when it has none
+func workloadSelector(selector *metav1.LabelSelector) labels.Selector {
+	if selector == nil {
+		return nil
+	}
+	converted, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil || converted.Empty() {
+		return nil
+	}
+	return converted
+}
+
+// notify queues a reconcile for every WorkloadManager waiting on one of the workloads
+func (w *workloadWatcher) notify(keys []string) {
+	w.mu.Lock()
+	var owners []types.NamespacedName
+	for _, key := range keys {
+		for owner := range w.watchers[key] {
+			owners = append(owners, owner)
+		}
+	}
+	w.mu.Unlock()
+
+	enqueue(w.events, owners)
+}
+
+// enqueue queues a reconcile for every WorkloadManager in owners without blocking
+func enqueue(events chan<- event.GenericEvent, owners []types.NamespacedName) {
+	for _, owner := range owners {
+		wlManager := &k8smanagersv1.WorkloadManager{}
+		wlManager.Namespace = owner.Namespace
+		wlManager.Name = owner.Name
+
+		// A missed event only delays the check until the next requeue
+		select {
+		case events <- event.GenericEvent{Object: wlManager}:
+		default:
+			log.Log.V(1).Info("Event queue full, dropping event", "namespace", owner.Namespace, "name", owner.Name)
+		}
+	}
+}
+
+// workloadKey identifies a workload across the watched kinds
+func workloadKey(wlType string, namespace string, name string) string {
+	return wlType + "/" + namespace + "/" + name
+}
@@ -17,26 +17,36 @@ limitations under the License.
 package controller
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/brianereynolds/k8smanagers_utils"
+	"golang.org/x/sync/singleflight"
 	k8smanagersv1 "greyridge.com/workloadManager/api/v1"
-	"greyridge.com/workloadManager/internal/controller/monitoring"
 	"greyridge.com/workloadManager/internal/controller/scheduling"
-	appsv1 "k8s.io/api/apps/v1"
-	v1 "k8s.io/api/core/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/client-go/kubernetes"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/rest"
 	"os"
 	"os/exec"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
 )
 
 // WorkloadManagerReconciler reconciles a WorkloadManager object
@@ -44,24 +54,69 @@ type WorkloadManagerReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
 
-	clientset *kubernetes.Clientset
+	// Config reaches the cluster the controller runs in, it is used by the inCluster login type
+	Config *rest.Config
+
+	// APIReader reads the WorkloadManager without the cache, so that a run always resumes from its
+	// latest recorded status and never repeats a step whose status the cache has not caught up with
+	APIReader client.Reader
+
+	// clusters caches the clients of every target cluster, see targetCluster
+	clustersMu sync.Mutex
+	clusters   map[clusterKey]*targetCluster
+	// logins runs a single login per target cluster, outside of clustersMu
+	logins singleflight.Group
+
+	// events carries the changes seen by the watchers on the target clusters to the controller
+	events chan event.GenericEvent
+	// secrets watches the Secrets the WorkloadManagers log in with, only set under the manager
+	secrets *secretWatcher
 }
 
-func isRunningInDocker() bool {
-	return os.Getenv("container") == "docker"
+// reader returns the reader of the WorkloadManager, the cache when no APIReader is set
+func (r *WorkloadManagerReconciler) reader() client.Reader {
+	if r.APIReader != nil {
+		return r.APIReader
+	}
+	return r.Client
 }
 
-func (r *WorkloadManagerReconciler) getClientSet(ctx context.Context, wlManager *k8smanagersv1.WorkloadManager) (*kubernetes.Clientset, error) {
+// getClientSet logs in to the target cluster of the WorkloadManager and returns the config for it
+func (r *WorkloadManagerReconciler) getClientSet(ctx context.Context, wlManager *k8smanagersv1.WorkloadManager) (*rest.Config, error) {
 	l := log.Log
 
-	if r.clientset != nil {
-		l.V(1).Info("Returning cached clientset")
-		return r.clientset, nil
+	l.Info("getClientSet using " + wlManager.Spec.SPNLoginType)
+
+	if wlManager.Spec.SPNLoginType == k8smanagersv1.InCluster {
+		if r.Config != nil {
+			return rest.CopyConfig(r.Config), nil
+		}
+		config, err := ctrl.GetConfig()
+		if err != nil {
+			l.Error(err, "Cannot load the in-cluster config")
+			return nil, err
+		}
+		return config, nil
 	}
 
-	l.Info("getClientSet using " + wlManager.Spec.SPNLoginType)
+	if wlManager.Spec.SPNLoginType == k8smanagersv1.KubeconfigSecret {
+		return r.kubeconfigSecretConfig(ctx, wlManager)
+	}
+
+	if wlManager.Spec.SPNLoginType == k8smanagersv1.AzureIdentity {
+		return r.azureIdentityConfig(ctx, wlManager)
+	}
+
+	if wlManager.Spec.SPNLoginType == k8smanagersv1.AzCli {
+		return r.azCliConfig(ctx, wlManager)
+	}
 
 	aksClient, err := k8smanagers_utils.GetManagedClusterClient(ctx, wlManager.Spec.SubscriptionID)
+	if err != nil {
+		l.Error(err, "Cannot create AKS client")
+		return nil, err
+	}
+
 	var kubeconfig []byte
 
 	if wlManager.Spec.SPNLoginType == k8smanagersv1.ListClusterAdminCredentials {
@@ -72,7 +127,9 @@ func (r *WorkloadManagerReconciler) getClientSet(ctx context.Context, wlManager
 			return nil, err
 		}
 
-		kubeconfig = kubeConfigResp.Kubeconfigs[0].Value
+		if len(kubeConfigResp.Kubeconfigs) > 0 && kubeConfigResp.Kubeconfigs[0] != nil {
+			kubeconfig = kubeConfigResp.Kubeconfigs[0].Value
+		}
 	}
 
 	if wlManager.Spec.SPNLoginType == k8smanagersv1.ListClusterUserCredentials {
@@ -82,304 +139,346 @@ func (r *WorkloadManagerReconciler) getClientSet(ctx context.Context, wlManager
 			return nil, err
 		}
 
-		kubeconfig = kubeConfigResp.Kubeconfigs[0].Value
+		if len(kubeConfigResp.Kubeconfigs) > 0 && kubeConfigResp.Kubeconfigs[0] != nil {
+			kubeconfig = kubeConfigResp.Kubeconfigs[0].Value
+		}
 	}
 
-	var kubeconfigpath = "/.kube/config"
-	if isRunningInDocker() == false {
-		kubeconfigpath = os.Getenv("HOME") + "/.kube/config"
+	// We should have a kubeconfig at this point
+	if kubeconfig == nil {
+		return nil, errors.New("Login has failed using " + wlManager.Spec.SPNLoginType)
 	}
 
-	if wlManager.Spec.SPNLoginType == k8smanagersv1.ListClusterUserCredentials ||
-		wlManager.Spec.SPNLoginType == k8smanagersv1.ListClusterAdminCredentials {
-
-		// We should have a kubeconfig at this point
-		if kubeconfig == nil {
-			err = errors.New("Login has failed using " + wlManager.Spec.SPNLoginType)
-			return nil, err
-		}
+	// Clusters using Entra ID list a kubeconfig running kubelogin, which the image does not ship:
+	// their requests carry tokens for the default Azure credential, the identity that listed it
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		l.Error(err, "Cannot build default Azure credential")
+		return nil, err
+	}
 
-		_, err = k8smanagers_utils.WriteKubeFile(kubeconfig)
-		if err != nil {
-			l.Error(err, "cannot write kubeconfig")
-			return nil, err
-		}
+	// The credentials are only kept in memory, in the clients of the target cluster
+	config, err := tokenConfig(kubeconfig, cred)
+	if err != nil {
+		l.Error(err, "Cannot load kubeconfig")
+		return nil, err
 	}
 
-	if wlManager.Spec.SPNLoginType == k8smanagersv1.AzCli {
-		azureClientId := os.Getenv("AZURE_CLIENT_ID")
-		azureTenantId := os.Getenv("AZURE_TENANT_ID")
-		azureClientSecret := os.Getenv("AZURE_CLIENT_SECRET")
-		cmd := exec.Command("az", "login", "--service-principal",
-			"--username", azureClientId,
-			"--tenant", azureTenantId,
-			"--password", azureClientSecret)
-		if azureClientId == "" {
-			return nil, errors.New("AZURE_CLIENT_ID is mandatory when using " + k8smanagersv1.AzCli)
-		}
-		if azureTenantId == "" {
-			return nil, errors.New("AZURE_TENANT_ID is mandatory when using " + k8smanagersv1.AzCli)
-		}
-		if azureClientSecret == "" {
-			return nil, errors.New("AZURE_CLIENT_SECRET is mandatory when using " + k8smanagersv1.AzCli)
-		}
+	return config, nil
+}
 
-		l.Info("az login: ", "cmd", strings.Replace(cmd.String(), os.Getenv("AZURE_CLIENT_SECRET"), "*********", -1))
-		result, err := cmd.CombinedOutput()
-		if err != nil {
-			l.Error(err, "failed to az login using Azure CLI", "error", string(result))
-			return nil, err
-		}
+// azCliConfig logs in to the target cluster through the Azure CLI. This is the only login type
+// keeping state on disk: the CLI stores its login under ~/.azure. The kubeconfig itself is printed
+// to stdout and requests carry tokens from the CLI, so neither ~/.kube/config nor kubelogin is used.
+func (r *WorkloadManagerReconciler) azCliConfig(ctx context.Context, wlManager *k8smanagersv1.WorkloadManager) (*rest.Config, error) {
+	l := log.Log
 
-		cmd = exec.Command("az", "account", "set", "--subscription", wlManager.Spec.SubscriptionID)
-		l.V(1).Info("az account set sub", "cmd", cmd)
-		result, err = cmd.CombinedOutput()
-		if err != nil {
-			l.Error(err, "failed to set subscription using Azure CLI", "error", string(result))
-			return nil, err
-		}
+	azureClientId := os.Getenv("AZURE_CLIENT_ID")
+	azureTenantId := os.Getenv("AZURE_TENANT_ID")
+	azureClientSecret := os.Getenv("AZURE_CLIENT_SECRET")
+	cmd := exec.CommandContext(ctx, "az", "login", "--service-principal",
+		"--username", azureClientId,
+		"--tenant", azureTenantId,
+		"--password", azureClientSecret)
+	if azureClientId == "" {
+		return nil, errors.New("AZURE_CLIENT_ID is mandatory when using " + k8smanagersv1.AzCli)
+	}
+	if azureTenantId == "" {
+		return nil, errors.New("AZURE_TENANT_ID is mandatory when using " + k8smanagersv1.AzCli)
+	}
+	if azureClientSecret == "" {
+		return nil, errors.New("AZURE_CLIENT_SECRET is mandatory when using " + k8smanagersv1.AzCli)
+	}
 
-		cmd = exec.Command("az", "aks", "get-credentials", "--resource-group", wlManager.Spec.ResourceGroup,
-			"--name", wlManager.Spec.ClusterName, "--overwrite-existing")
-		l.V(1).Info("az aks get creds", "cmd", cmd)
-		result, err = cmd.CombinedOutput()
-		if err != nil {
-			l.Error(err, "Failed to get kubeconfig using Azure CLI", "output", string(result))
-			return nil, err
-		}
+	l.Info("az login: ", "cmd", strings.Replace(cmd.String(), os.Getenv("AZURE_CLIENT_SECRET"), "*********", -1))
+	result, err := cmd.CombinedOutput()
+	if err != nil {
+		l.Error(err, "failed to az login using Azure CLI", "error", string(result))
+		return nil, err
+	}
 
-		cmd = exec.Command("kubelogin", "convert-kubeconfig", "-l", "azurecli")
-		l.V(1).Info("kubelogin", "cmd", cmd)
-		result, err = cmd.CombinedOutput()
-		if err != nil {
-			l.Error(err, "Failed to kubelogin", "output", string(result))
-			return nil, err
-		}
+	// The subscription is passed to each command rather than set on the shared CLI profile,
+	// which other WorkloadManagers may be using at the same time
+	cmd = exec.CommandContext(ctx, "az", "aks", "get-credentials", "--resource-group", wlManager.Spec.ResourceGroup,
+		"--name", wlManager.Spec.ClusterName, "--subscription", wlManager.Spec.SubscriptionID, "--file", "-")
+	l.V(1).Info("az aks get creds", "cmd", cmd)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	kubeconfig, err := cmd.Output()
+	if err != nil {
+		l.Error(err, "Failed to get kubeconfig using Azure CLI", "output", stderr.String())
+		return nil, err
 	}
 
-	clientset, err := k8smanagers_utils.GetClientSet(ctx, kubeconfigpath)
+	cred, err := azidentity.NewAzureCLICredential(&azidentity.AzureCLICredentialOptions{
+		Subscription: wlManager.Spec.SubscriptionID,
+		TenantID:     azureTenantId,
+	})
 	if err != nil {
-		l.Error(err, "Cannot GetClientSet")
+		l.Error(err, "Cannot build Azure CLI credential")
 		return nil, err
 	}
-	r.clientset = clientset
 
-	return r.clientset, nil
+	config, err := tokenConfig(kubeconfig, cred)
+	if err != nil {
+		l.Error(err, "Cannot load kubeconfig")
+		return nil, err
+	}
 
+	return config, nil
 }
 
-// validate will check the contents of the Workload Manager configuration
+// validate will check the contents of the Workload Manager configuration. Every procedure
+// is checked and all failures are returned together.
 func (r *WorkloadManagerReconciler) validate(ctx context.Context, wlManager *k8smanagersv1.WorkloadManager) error {
-	clientset, err := r.getClientSet(ctx, wlManager)
+	if _, err := procedureDependencies(wlManager.Spec.Procedures); err != nil {
+		return err
+	}
+
+	cluster, err := r.targetCluster(ctx, wlManager)
 	if err != nil {
 		return err
 	}
 
-	for _, procedure := range wlManager.Spec.Procedures {
+	var errs []error
+
+	for i, procedure := range wlManager.Spec.Procedures {
+		setProcedurePhase(wlManager, i, k8smanagersv1.PhaseValidating)
+		r.updateStatus(ctx, wlManager)
+
+		var procErrs []error
+
 		if procedure.Type == k8smanagersv1.StatefulSet {
-			err = r.validateProcedures(ctx, clientset, procedure, k8smanagersv1.StatefulSet)
+			procErrs = r.validateProcedures(ctx, cluster, wlManager, i, k8smanagersv1.StatefulSet)
+		} else if procedure.Type == k8smanagersv1.Deployment {
+			procErrs = r.validateProcedures(ctx, cluster, wlManager, i, k8smanagersv1.Deployment)
+		} else if procedure.Type == k8smanagersv1.DaemonSet {
+			procErrs = r.validateProcedures(ctx, cluster, wlManager, i, k8smanagersv1.DaemonSet)
+		} else if procedure.Type == k8smanagersv1.CronJob {
+			procErrs = r.validateProcedures(ctx, cluster, wlManager, i, k8smanagersv1.CronJob)
+		} else if procedure.Type == k8smanagersv1.Job {
+			procErrs = r.validateProcedures(ctx, cluster, wlManager, i, k8smanagersv1.Job)
+		} else if procedure.Type == k8smanagersv1.Custom && procedure.Custom == nil {
+			procErrs = append(procErrs, fmt.Errorf("procedure %q: type %q requires custom.apiVersion and custom.kind", procedureName(procedure, i), procedure.Type))
+		} else if procedure.Type == k8smanagersv1.Custom {
+			procErrs = r.validateProcedures(ctx, cluster, wlManager, i, k8smanagersv1.Custom)
+		} else {
+			procErrs = append(procErrs, fmt.Errorf("procedure %q: unsupported type %q", procedureName(procedure, i), procedure.Type))
 		}
 
-		if procedure.Type == k8smanagersv1.Deployment {
-			err = r.validateProcedures(ctx, clientset, procedure, k8smanagersv1.Deployment)
+		if len(procErrs) > 0 {
+			setProcedurePhase(wlManager, i, k8smanagersv1.PhaseFailed)
+			errs = append(errs, procErrs...)
+			continue
 		}
+		setProcedurePhase(wlManager, i, k8smanagersv1.PhasePending)
 	}
+	r.updateStatus(ctx, wlManager)
 
-	return nil
+	return utilerrors.NewAggregate(errs)
 }
 
-func (r *WorkloadManagerReconciler) validateProcedures(ctx context.Context, clientset *kubernetes.Clientset, procedure k8smanagersv1.Procedure, wlType string) error {
+// validateProcedures checks every workload of the procedure at index, returning one error per failing workload
+func (r *WorkloadManagerReconciler) validateProcedures(ctx context.Context, cluster *targetCluster, wlManager *k8smanagersv1.WorkloadManager, index int, wlType string) []error {
 	l := log.Log
 
-	for _, workload := range procedure.Workloads {
+	var errs []error
 
-		var affinity *v1.NodeAffinity
-		var selector *metav1.LabelSelector
+	procedure := wlManager.Spec.Procedures[index]
 
-		if wlType == k8smanagersv1.StatefulSet {
-			statefulset, err := clientset.AppsV1().StatefulSets(procedure.Namespace).Get(ctx, workload, metav1.GetOptions{})
-			if err != nil {
-				l.Error(err, "Stateful not found", "namespace", procedure.Namespace, "name", workload)
-				return err
-			}
-			if scheduling.HasAffinity(statefulset) {
-				affinity = statefulset.Spec.Template.Spec.Affinity.NodeAffinity
-			}
-			if scheduling.HasSelector(statefulset) {
-				selector = statefulset.Spec.Selector
-			}
-		}
-		if wlType == k8smanagersv1.Deployment {
-			deployment, err := clientset.AppsV1().Deployments(procedure.Namespace).Get(ctx, workload, metav1.GetOptions{})
-			if err != nil {
-				l.Error(err, "Deployment not found", "namespace", procedure.Namespace, "name", workload)
-				return err
-			}
+	if err := r.resolveWorkloads(ctx, cluster, wlManager, index, wlType); err != nil {
+		err = fmt.Errorf("procedure %q: %w", procedureName(procedure, index), err)
+		l.Error(err, "Could not resolve the workload selector")
+		return []error{err}
+	}
 
-			if scheduling.HasAffinity(deployment) {
-				affinity = deployment.Spec.Template.Spec.Affinity.NodeAffinity
-			}
-			if scheduling.HasSelector(deployment) {
-				selector = deployment.Spec.Selector
-			}
-		}
+	for _, ref := range workloadRefs(wlManager, index) {
+		// Workloads found through the namespace selector live outside the procedure's namespace
+		procedure := procedure
+		procedure.Namespace = ref.Namespace
+		workload := ref.Name
 
-		if affinity == nil && selector == nil {
-			err := errors.New("could not find any any node affinity or node selector")
+		wlStatus := workloadStatus(wlManager, index, ref.Namespace, workload)
+		fail := func(err error) {
+			err = workloadError(wlType, procedure.Namespace, workload, err)
 			l.Error(err, "Validation failed")
-			return err
+			finishWorkload(wlStatus, k8smanagersv1.PhaseFailed, err)
+			errs = append(errs, err)
 		}
 
-		err := scheduling.CheckNodeAffinity(affinity, procedure, workload)
-		if err != nil {
-			return err
-		}
-		err = scheduling.CheckNodeSelector(selector, procedure, workload)
+		resource, err := r.getWorkload(ctx, cluster, procedure, wlType, workload)
 		if err != nil {
-			return err
+			fail(err)
+			continue
 		}
-	}
-
-	return nil
-}
 
-func (r *WorkloadManagerReconciler) apply(ctx context.Context, wlManager *k8smanagersv1.WorkloadManager) error {
-	l := log.Log
+		wlStatus.NodePool = scheduling.NodePool(resource, procedure)
 
-	clientset, err := r.getClientSet(ctx, wlManager)
-	if err != nil {
-		return err
-	}
-
-	for _, procedure := range wlManager.Spec.Procedures {
+		if scheduling.IsOnTarget(resource, procedure) {
+			continue
+		}
 
-		if wlManager.Spec.TestMode {
-			l.Info("TEST MODE: The controller will try to set the affinity", "workloads", procedure.Workloads, "key", procedure.Affinity.Key, "from", procedure.Affinity.Initial, "to", procedure.Affinity.Target)
+		if !scheduling.HasAffinity(resource) && !scheduling.HasSelector(resource) {
+			fail(errors.New("could not find any node affinity or node selector"))
 			continue
 		}
 
-		if procedure.Type == k8smanagersv1.StatefulSet {
-			err = r.updateScheduling(ctx, clientset, procedure, k8smanagersv1.StatefulSet)
+		// The pod template of a Job can only change while it is suspended
+		if job, ok := resource.(*batchv1.Job); ok && (job.Spec.Suspend == nil || !*job.Spec.Suspend) {
+			fail(errors.New("the scheduling of a job can only be changed while it is suspended"))
+			continue
 		}
 
-		if procedure.Type == k8smanagersv1.Deployment {
-			err = r.updateScheduling(ctx, clientset, procedure, k8smanagersv1.Deployment)
+		if err := scheduling.CheckInitial(resource, procedure, workload); err != nil {
+			if procedure.OnMismatch == k8smanagersv1.MismatchSkip {
+				l.Info("Workload is not on the initial node pool and will be skipped", "namespace", procedure.Namespace, "name", workload)
+				finishWorkload(wlStatus, k8smanagersv1.PhaseSkipped, err)
+				continue
+			}
+			fail(err)
+			continue
 		}
 
-		if err != nil {
-			return err
+		// The warn policy moves the workload anyway, the mismatch is kept on its status
+		if err := scheduling.InitialMismatch(resource, procedure); err != nil {
+			wlStatus.Message = "Not on the initial node pool, moving it anyway: " + err.Error()
 		}
 	}
 
-	return nil
+	return errs
 }
 
-func (r *WorkloadManagerReconciler) updateScheduling(ctx context.Context, clientset *kubernetes.Clientset, procedure k8smanagersv1.Procedure, wlType string) error {
-	l := log.Log
+// workloadError prefixes err with the type, namespace and name of the workload it relates to
+func workloadError(wlType string, namespace string, workload string, err error) error {
+	return fmt.Errorf("%s %s/%s: %w", wlType, namespace, workload, err)
+}
 
-	var deployment *appsv1.Deployment
-	var statefulset *appsv1.StatefulSet
-	var err error
-	var interval time.Duration
+// maxConcurrent returns how many workloads of the procedure at index may be moved at once
+func maxConcurrent(wlManager *k8smanagersv1.WorkloadManager, index int) int {
+	if limit := wlManager.Spec.Procedures[index].MaxConcurrent; limit > 0 {
+		return limit
+	}
+	if limit := wlManager.Spec.MaxConcurrent; limit > 0 {
+		return limit
+	}
+	return 1
+}
 
+// rollbackProcedure returns a copy of the procedure that targets its Initial affinity and selector
+func rollbackProcedure(procedure k8smanagersv1.Procedure) k8smanagersv1.Procedure {
+	procedure.Affinity.Initial, procedure.Affinity.Target = procedure.Affinity.Target, procedure.Affinity.Initial
+	procedure.Selector.Initial, procedure.Selector.Target = procedure.Selector.Target, procedure.Selector.Initial
+	procedure.Selector.Remove = false
 	if procedure.Timeout == 0 {
 		procedure.Timeout = 600
 	}
+	return procedure
+}
 
-	for _, workload := range procedure.Workloads {
-		if wlType == k8smanagersv1.StatefulSet {
-			statefulset, err = clientset.AppsV1().StatefulSets(procedure.Namespace).Get(ctx, workload, metav1.GetOptions{})
-			if err != nil {
-				l.Error(err, "Stateful not found", "namespace", procedure.Namespace, "name", workload)
-				return err
-			}
-
-			if scheduling.HasAffinity(statefulset) {
-				l.V(1).Info("Statefulset has Affinity", "Key", procedure.Affinity.Key, "Target", procedure.Affinity.Target)
-				statefulset.Spec.Template.Spec.Affinity.NodeAffinity = scheduling.CreateNodeAffinity(procedure.Affinity.Key, procedure.Affinity.Target)
-			}
-			if scheduling.HasSelector(statefulset) {
-				l.V(1).Info("Statefulset has Selector", "Key", procedure.Selector.Key, "Target", procedure.Selector.Target)
-				statefulset.Spec.Template.Spec.NodeSelector = scheduling.CreateNodeSelector(procedure.Selector.Key, procedure.Selector.Target)
-			}
+// errFieldConflict marks a workload whose scheduling fields are owned by another field manager
+var errFieldConflict = errors.New("field conflict")
 
-			_, err = clientset.AppsV1().StatefulSets(procedure.Namespace).Update(ctx, statefulset, metav1.UpdateOptions{})
-			if err != nil {
-				l.Error(err, "Error updating statefulset", "namespace", procedure.Namespace, "name", workload)
-				return err
-			}
-			interval = 30 * time.Second
-			time.Sleep(30 * time.Second) // Pause to allow affinity injection to take
-		}
-		if wlType == k8smanagersv1.Deployment {
-			deployment, err = clientset.AppsV1().Deployments(procedure.Namespace).Get(ctx, workload, metav1.GetOptions{})
-			if err != nil {
-				l.Error(err, "Deployment not found", "namespace", procedure.Namespace, "name", workload)
-				return err
-			}
-			if scheduling.HasAffinity(deployment) {
-				l.V(1).Info("Deployment has Affinity", "Key", procedure.Affinity.Key, "Target", procedure.Affinity.Target)
-				deployment.Spec.Template.Spec.Affinity.NodeAffinity = scheduling.CreateNodeAffinity(procedure.Affinity.Key, procedure.Affinity.Target)
-			}
-			if scheduling.HasSelector(deployment) {
-				l.V(1).Info("Deployment has Selector", "Key", procedure.Selector.Key, "Target", procedure.Selector.Target)
-				deployment.Spec.Template.Spec.NodeSelector = scheduling.CreateNodeSelector(procedure.Selector.Key, procedure.Selector.Target)
-			}
+// Helper function to get whether the procedure takes over conflicting fields, false unless set otherwise
+func forceConflicts(procedure k8smanagersv1.Procedure) *bool {
+	force := procedure.ForceConflicts != nil && *procedure.ForceConflicts
+	return &force
+}
 
-			deployment, err = clientset.AppsV1().Deployments(procedure.Namespace).Update(ctx, deployment, metav1.UpdateOptions{})
-			if err != nil {
-				l.Error(err, "Error updating deployment", "namespace", procedure.Namespace, "name", workload)
-				return err
-			}
-			if procedure.Timeout > 10 {
-				time.Sleep(10 * time.Second) // Pause to allow affinity injection to take
-			}
-			interval = 10 * time.Second
-		}
+// patchScheduling moves the workload to the procedure's Target with server-side apply patches, the
+// affinity and each selector key owned by their own field manager. Fields owned by other managers are
+// only taken over when the procedure sets ForceConflicts to true.
+func (r *WorkloadManagerReconciler) patchScheduling(ctx context.Context, cluster *targetCluster, resource interface{}, procedure k8smanagersv1.Procedure, wlType string) (interface{}, error) {
+	name := resource.(metav1.Object).GetName()
 
-		ctx = context.WithValue(ctx, "namespace", procedure.Namespace)
-		ctx = context.WithValue(ctx, "clientset", clientset)
-		if wlType == k8smanagersv1.Deployment {
-			ctx = context.WithValue(ctx, "resource", deployment)
+	applyPatches, err := scheduling.TargetApplyPatches(resource, procedure)
+	if err != nil {
+		return nil, err
+	}
+	for _, applyPatch := range applyPatches {
+		resource, err = r.patchWorkload(ctx, cluster, procedure, wlType, name, types.ApplyPatchType, applyPatch.Data,
+			metav1.PatchOptions{FieldManager: applyPatch.FieldManager, Force: forceConflicts(procedure)})
+		if k8serrors.IsConflict(err) {
+			return nil, fmt.Errorf("%w: %w: set forceConflicts: true to take ownership", errFieldConflict, err)
 		}
-		if wlType == k8smanagersv1.StatefulSet {
-			ctx = context.WithValue(ctx, "resource", statefulset)
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		timeout := time.Duration(procedure.Timeout) * time.Second
-		l.Info("Starting to wait", "name", workload, "timeout", timeout)
-		waitForConditionWithTimeout(func() bool {
-			return monitoring.IsResourceReady(ctx, wlType)
-		}, interval, timeout)
+	removePatch, err := scheduling.RemoveSelectorPatch(resource, procedure)
+	if err != nil {
+		return nil, err
+	}
+	if removePatch != nil {
+		resource, err = r.patchWorkload(ctx, cluster, procedure, wlType, name, types.MergePatchType, removePatch,
+			metav1.PatchOptions{FieldManager: scheduling.FieldManager})
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return nil
+	return resource, nil
 }
 
-func waitForConditionWithTimeout(condFunc func() bool, interval, timeout time.Duration) bool {
-	l := log.Log
+// getWorkload fetches the named workload of the given type
+func (r *WorkloadManagerReconciler) getWorkload(ctx context.Context, cluster *targetCluster, procedure k8smanagersv1.Procedure, wlType string, name string) (interface{}, error) {
+	namespace := procedure.Namespace
 
-	timeoutChan := time.After(timeout) // Set the timeout period
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-timeoutChan:
-			l.Info("Waiting time exceeded", "timeout", timeout.String())
-			return false
-		case <-ticker.C:
-			if condFunc() {
-				ticker.Stop() // Explicitly stop ticker
-				return true
-			}
-		}
+	if wlType == k8smanagersv1.StatefulSet {
+		return cluster.clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+	if wlType == k8smanagersv1.Deployment {
+		return cluster.clientset.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+	if wlType == k8smanagersv1.DaemonSet {
+		return cluster.clientset.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+	if wlType == k8smanagersv1.CronJob {
+		return cluster.clientset.BatchV1().CronJobs(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+	if wlType == k8smanagersv1.Job {
+		return cluster.clientset.BatchV1().Jobs(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+	if wlType == k8smanagersv1.Custom {
+		return r.getCustomWorkload(ctx, cluster, procedure, name)
+	}
+	return nil, fmt.Errorf("unsupported type %q", wlType)
+}
+
+// patchWorkload sends the patch to the named workload of the given type
+func (r *WorkloadManagerReconciler) patchWorkload(ctx context.Context, cluster *targetCluster, procedure k8smanagersv1.Procedure, wlType string, name string, patchType types.PatchType, data []byte, opts metav1.PatchOptions) (interface{}, error) {
+	namespace := procedure.Namespace
+
+	if wlType == k8smanagersv1.StatefulSet {
+		return cluster.clientset.AppsV1().StatefulSets(namespace).Patch(ctx, name, patchType, data, opts)
+	}
+	if wlType == k8smanagersv1.Deployment {
+		return cluster.clientset.AppsV1().Deployments(namespace).Patch(ctx, name, patchType, data, opts)
+	}
+	if wlType == k8smanagersv1.DaemonSet {
+		return cluster.clientset.AppsV1().DaemonSets(namespace).Patch(ctx, name, patchType, data, opts)
 	}
+	if wlType == k8smanagersv1.CronJob {
+		return cluster.clientset.BatchV1().CronJobs(namespace).Patch(ctx, name, patchType, data, opts)
+	}
+	if wlType == k8smanagersv1.Job {
+		return cluster.clientset.BatchV1().Jobs(namespace).Patch(ctx, name, patchType, data, opts)
+	}
+	if wlType == k8smanagersv1.Custom {
+		return r.patchCustomWorkload(ctx, cluster, procedure, name, patchType, data, opts)
+	}
+	return nil, fmt.Errorf("unsupported type %q", wlType)
 }
 
 // +kubebuilder:rbac:groups=k8smanagers.greyridge.com,resources=workloadmanagers,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=k8smanagers.greyridge.com,resources=workloadmanagers/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=k8smanagers.greyridge.com,resources=workloadmanagers/finalizers,verbs=update
+// +kubebuilder:rbac:groups=apps,resources=deployments;statefulsets;daemonsets,verbs=get;list;watch;patch
+// +kubebuilder:rbac:groups=batch,resources=cronjobs;jobs,verbs=get;list;watch;patch
+// +kubebuilder:rbac:groups="",resources=pods;namespaces,verbs=get;list;watch
+// Secrets are watched one at a time, by name and metadata only, in the namespace of the WorkloadManager
+// using them. WorkloadManagers can be created in any namespace, so the rule cannot be namespaced.
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -396,15 +495,28 @@ func (r *WorkloadManagerReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 
 	var wlManager k8smanagersv1.WorkloadManager
 
-	if err := r.Get(ctx, req.NamespacedName, &wlManager); err != nil {
+	if err := r.reader().Get(ctx, req.NamespacedName, &wlManager); err != nil {
 		if k8serrors.IsNotFound(err) {
 			// Resource was deleted, clean up and exit reconciliation
+			r.releaseCluster(req.NamespacedName)
 			l.Info("Exit Reconcile - No WL manager config found")
 			return ctrl.Result{}, nil
 		}
 		return ctrl.Result{}, err
 	}
 
+	// A run that is over keeps no clients or informers on the target cluster
+	defer func() {
+		if !isInProgress(&wlManager) {
+			r.releaseCluster(req.NamespacedName)
+		}
+	}()
+
+	if isCompleted(&wlManager) {
+		l.Info("Exit Reconcile - Procedures already completed", "generation", wlManager.Generation)
+		return ctrl.Result{}, nil
+	}
+
 	// Defaults
 	if wlManager.Spec.SPNLoginType == "" {
 		l.V(1).Info("Setting default SPNLoginType " + k8smanagersv1.ListClusterAdminCredentials)
@@ -414,23 +526,61 @@ func (r *WorkloadManagerReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 	requeue := wlManager.Spec.RetryOnError
 	l.V(1).Info("Retry on error " + strconv.FormatBool(wlManager.Spec.RetryOnError))
 
-	if err := r.validate(ctx, &wlManager); err != nil {
-		l.Error(err, "Error during validate")
-		return ctrl.Result{Requeue: requeue}, nil
+	if !isInProgress(&wlManager) {
+		initStatus(&wlManager)
+		setCondition(&wlManager, k8smanagersv1.ConditionProgressing, metav1.ConditionTrue, "Reconciling", "Procedures are being validated and applied")
+		setCondition(&wlManager, k8smanagersv1.ConditionReady, metav1.ConditionFalse, "Reconciling", "Procedures are being validated and applied")
+
+		if err := r.validate(ctx, &wlManager); err != nil {
+			if ctx.Err() != nil {
+				// Nothing has been moved yet, the next leader validates again
+				l.Info("Exit Reconcile - Cancelled during validate")
+				return ctrl.Result{}, ctx.Err()
+			}
+			l.Error(err, "Error during validate")
+			setCondition(&wlManager, k8smanagersv1.ConditionValidated, metav1.ConditionFalse, "ValidationFailed", err.Error())
+			r.markFailed(ctx, &wlManager, "ValidationFailed", err)
+			return ctrl.Result{Requeue: requeue}, nil
+		}
+		setCondition(&wlManager, k8smanagersv1.ConditionValidated, metav1.ConditionTrue, "ValidationSucceeded", "All procedures are valid")
+
+		// The procedures are applied from the next reconcile on, one step at a time
+		wlManager.Status.Phase = k8smanagersv1.PhaseApplying
+		r.updateStatus(ctx, &wlManager)
+		l.Info("Exit Reconcile - Procedures validated")
+		return ctrl.Result{Requeue: true}, nil
 	}
 
-	if err := r.apply(ctx, &wlManager); err != nil {
+	result, err := r.step(ctx, &wlManager)
+	if err != nil && ctx.Err() != nil {
+		l.Info("Exit Reconcile - Cancelled, the run resumes from the recorded step")
+		return ctrl.Result{}, err
+	}
+	if err != nil {
 		l.Error(err, "Error during apply")
+		r.markFailed(ctx, &wlManager, failureReason(&wlManager, "ApplyFailed"), err)
 		return ctrl.Result{Requeue: requeue}, nil
 	}
 
 	l.Info("Exit Reconcile")
-	return ctrl.Result{}, nil
+	return result, nil
 }
 
-// SetupWithManager sets up the controller with the Manager.
+// SetupWithManager sets up the controller with the Manager. Changes to the workloads being moved,
+// and to their pods, reach the controller through the events channel, as do changes to the Secrets
+// the WorkloadManagers log in with, see credentialVersion.
 func (r *WorkloadManagerReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.events = make(chan event.GenericEvent, 1024)
+
+	metadataClient, err := metadata.NewForConfig(mgr.GetConfig())
+	if err != nil {
+		return err
+	}
+	r.secrets = newSecretWatcher(metadataClient, r.events)
+
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&k8smanagersv1.WorkloadManager{}).
+		For(&k8smanagersv1.WorkloadManager{}, builder.WithPredicates(
+			predicate.Or(predicate.GenerationChangedPredicate{}, predicate.AnnotationChangedPredicate{}))).
+		WatchesRawSource(source.Channel(r.events, &handler.EnqueueRequestForObject{})).
 		Complete(r)
 }
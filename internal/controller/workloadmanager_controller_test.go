@@ -21,17 +21,39 @@ package controller
 
 import (
 	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerservice/armcontainerservice"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"go.uber.org/zap/zapcore"
 	k8smanagersv1 "greyridge.com/workloadManager/api/v1"
+	"greyridge.com/workloadManager/internal/controller/monitoring"
+	"greyridge.com/workloadManager/internal/controller/scheduling"
+	"io"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/metadata"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"net/http"
+	"os"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -44,17 +66,26 @@ var _ = Describe("WorkloadManager Controller", func() {
 
 		var deployment *appsv1.Deployment
 		var statefulset *appsv1.StatefulSet
+		var daemonset *appsv1.DaemonSet
+		var cronjob *batchv1.CronJob
+		var job *batchv1.Job
 		var resource *k8smanagersv1.WorkloadManager
 
 		BeforeEach(func() {
 			deployment = newDeployment()
 			statefulset = newStatefulset()
+			daemonset = newDaemonset()
+			cronjob = newCronjob()
+			job = newJob()
 			resource = newResource()
 		})
 
 		AfterEach(func() {
 			_ = k8sClient.Delete(ctx, deployment)
 			_ = k8sClient.Delete(ctx, statefulset)
+			_ = k8sClient.Delete(ctx, daemonset)
+			_ = k8sClient.Delete(ctx, cronjob)
+			_ = k8sClient.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground))
 			_ = k8sClient.Delete(ctx, resource)
 
 			time.Sleep(5 * time.Second)
@@ -126,6 +157,337 @@ var _ = Describe("WorkloadManager Controller", func() {
 			Expect(actualAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions[0].Values).To(ContainElement("targetaffinity"))
 		})
 
+		It("Test selector procedure keeps the affinity of an earlier procedure", func() {
+			resource.Spec.Procedures = append(resource.Spec.Procedures,
+				k8smanagersv1.Procedure{
+					Name:      "affinity",
+					Type:      "deployment",
+					Namespace: "default",
+					Workloads: []string{deployment.Name},
+					Affinity: k8smanagersv1.Affinity{
+						Key:     "agentpool",
+						Initial: "initialaffinity",
+						Target:  "targetaffinity",
+					},
+					Timeout: 5,
+				},
+				k8smanagersv1.Procedure{
+					Name:      "selector",
+					DependsOn: []string{"affinity"},
+					Type:      "deployment",
+					Namespace: "default",
+					Workloads: []string{deployment.Name},
+					Selector: k8smanagersv1.Selector{
+						Key:     "pasx/node",
+						Initial: "miscblue",
+						Target:  "miscgreen",
+					},
+					Timeout: 5,
+				})
+			Expect(createResource(resource)).To(Succeed())
+
+			deployment.Spec.Template.Spec.Affinity = &corev1.Affinity{NodeAffinity: scheduling.CreateNodeAffinity("agentpool", "initialaffinity")}
+			deployment.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscblue",
+			}
+			Expect(createDeployment(deployment)).To(Succeed())
+
+			// Every rollout is reported as finished, so both procedures succeed
+			deployment.Status = appsv1.DeploymentStatus{
+				ObservedGeneration: 10,
+				Replicas:           1,
+				UpdatedReplicas:    1,
+				ReadyReplicas:      1,
+				AvailableReplicas:  1,
+			}
+			Expect(k8sClient.Status().Update(ctx, deployment)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+			Expect(actualResource.Status.Phase).To(Equal(k8smanagersv1.PhaseSucceeded))
+
+			actualDeployment := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(deployment), actualDeployment)).To(Succeed())
+			Expect(actualDeployment.Spec.Template.Spec.NodeSelector).To(HaveKeyWithValue("pasx/node", "miscgreen"))
+			Expect(scheduling.NodePool(actualDeployment, resource.Spec.Procedures[0])).To(Equal("targetaffinity"))
+
+			managers := []string{}
+			for _, entry := range actualDeployment.ManagedFields {
+				managers = append(managers, entry.Manager)
+			}
+			Expect(managers).To(ContainElements(scheduling.AffinityFieldManager, scheduling.SelectorFieldManager("pasx/node")))
+		})
+
+		It("Test status on Deployment", func() {
+			procedure := k8smanagersv1.Procedure{
+				Type:      "deployment",
+				Namespace: "default",
+				Workloads: []string{deployment.Name},
+				Selector: k8smanagersv1.Selector{
+					Key:     "pasx/node",
+					Initial: "miscblue",
+					Target:  "miscgreen",
+				},
+				Timeout: 5,
+			}
+
+			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
+			Expect(createResource(resource)).To(Succeed())
+
+			deployment.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscblue",
+			}
+
+			Expect(createDeployment(deployment)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			// Get resource and check status, it should record the procedure and workload progress
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+
+			Expect(actualResource.Status.Procedures).To(HaveLen(1))
+			Expect(actualResource.Status.Procedures[0].Phase).To(BeElementOf(k8smanagersv1.PhaseSucceeded, k8smanagersv1.PhaseTimedOut))
+			Expect(actualResource.Status.Procedures[0].Workloads).To(HaveLen(1))
+
+			wlStatus := actualResource.Status.Procedures[0].Workloads[0]
+			Expect(wlStatus.Name).To(Equal(deployment.Name))
+			Expect(wlStatus.StartTime).NotTo(BeNil())
+			Expect(wlStatus.EndTime).NotTo(BeNil())
+			Expect(wlStatus.NodePool).To(Equal("miscgreen"))
+
+			Expect(actualResource.Status.ObservedGeneration).To(Equal(actualResource.Generation))
+			Expect(meta.IsStatusConditionTrue(actualResource.Status.Conditions, k8smanagersv1.ConditionValidated)).To(BeTrue())
+			Expect(meta.IsStatusConditionFalse(actualResource.Status.Conditions, k8smanagersv1.ConditionProgressing)).To(BeTrue())
+		})
+
+		It("Test Deployment already on target is not updated", func() {
+			procedure := k8smanagersv1.Procedure{
+				Type:      "deployment",
+				Namespace: "default",
+				Workloads: []string{deployment.Name},
+				Selector: k8smanagersv1.Selector{
+					Key:     "pasx/node",
+					Initial: "miscblue",
+					Target:  "miscgreen",
+				},
+				Timeout: 5,
+			}
+
+			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
+			Expect(createResource(resource)).To(Succeed())
+
+			deployment.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscgreen",
+			}
+
+			Expect(createDeployment(deployment)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			// Get deployment and check generation, the spec should not have been updated
+			actualDeployment := &appsv1.Deployment{}
+
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: deployment.ObjectMeta.Namespace,
+				Name:      deployment.ObjectMeta.Name,
+			}, actualDeployment)).To(Succeed())
+
+			Expect(actualDeployment.Generation).To(Equal(int64(1)))
+			Expect(actualDeployment.Spec.Template.Spec.NodeSelector).To(HaveKeyWithValue("pasx/node", "miscgreen"))
+		})
+
+		It("Test procedures run once per generation", func() {
+			procedure := k8smanagersv1.Procedure{
+				Type:      "deployment",
+				Namespace: "default",
+				Workloads: []string{deployment.Name},
+				Selector: k8smanagersv1.Selector{
+					Key:     "pasx/node",
+					Initial: "miscblue",
+					Target:  "miscgreen",
+				},
+				Timeout: 5,
+			}
+
+			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
+			Expect(createResource(resource)).To(Succeed())
+
+			deployment.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscblue",
+			}
+
+			Expect(createDeployment(deployment)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			// Move the deployment back, a second reconcile of the same generation should leave it alone
+			actualDeployment := &appsv1.Deployment{}
+			deploymentKey := client.ObjectKey{
+				Namespace: deployment.ObjectMeta.Namespace,
+				Name:      deployment.ObjectMeta.Name,
+			}
+
+			Expect(k8sClient.Get(ctx, deploymentKey, actualDeployment)).To(Succeed())
+			actualDeployment.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscblue",
+			}
+			Expect(k8sClient.Update(ctx, actualDeployment)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			Expect(k8sClient.Get(ctx, deploymentKey, actualDeployment)).To(Succeed())
+			Expect(actualDeployment.Spec.Template.Spec.NodeSelector).To(HaveKeyWithValue("pasx/node", "miscblue"))
+
+			// Setting the rerun annotation should run the procedures again
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+			actualResource.Annotations = map[string]string{k8smanagersv1.RerunAnnotation: "1"}
+			Expect(k8sClient.Update(ctx, actualResource)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			Expect(k8sClient.Get(ctx, deploymentKey, actualDeployment)).To(Succeed())
+			Expect(actualDeployment.Spec.Template.Spec.NodeSelector).To(HaveKeyWithValue("pasx/node", "miscgreen"))
+		})
+
+		It("Test validation failure blocks apply", func() {
+			resource.Spec.Procedures = append(resource.Spec.Procedures,
+				k8smanagersv1.Procedure{
+					Type:      "deployment",
+					Namespace: "default",
+					Workloads: []string{deployment.Name},
+					Selector: k8smanagersv1.Selector{
+						Key:     "pasx/node",
+						Initial: "miscblue",
+						Target:  "miscgreen",
+					},
+					Timeout: 5,
+				},
+				k8smanagersv1.Procedure{
+					Type:      "deployment",
+					Namespace: "default",
+					Workloads: []string{"missing-deployment"},
+					Selector: k8smanagersv1.Selector{
+						Key:     "pasx/node",
+						Initial: "miscblue",
+						Target:  "miscgreen",
+					},
+					Timeout: 5,
+				})
+			Expect(createResource(resource)).To(Succeed())
+
+			deployment.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscblue",
+			}
+
+			Expect(createDeployment(deployment)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			// Get resource and check the validation failure names the missing workload
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+
+			validated := meta.FindStatusCondition(actualResource.Status.Conditions, k8smanagersv1.ConditionValidated)
+			Expect(validated).NotTo(BeNil())
+			Expect(validated.Status).To(Equal(metav1.ConditionFalse))
+			Expect(validated.Message).To(ContainSubstring("default/missing-deployment"))
+			Expect(actualResource.Status.Procedures[1].Phase).To(Equal(k8smanagersv1.PhaseFailed))
+
+			// Get deployment and check node selector, it should not have been moved
+			actualDeployment := &appsv1.Deployment{}
+
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: deployment.ObjectMeta.Namespace,
+				Name:      deployment.ObjectMeta.Name,
+			}, actualDeployment)).To(Succeed())
+
+			Expect(actualDeployment.Spec.Template.Spec.NodeSelector).To(HaveKeyWithValue("pasx/node", "miscblue"))
+		})
+
+		It("Test skip on mismatch leaves Deployment in place", func() {
+			procedure := k8smanagersv1.Procedure{
+				Type:      "deployment",
+				Namespace: "default",
+				Workloads: []string{deployment.Name},
+				Selector: k8smanagersv1.Selector{
+					Key:     "pasx/node",
+					Initial: "miscblue",
+					Target:  "miscgreen",
+				},
+				Timeout:    5,
+				OnMismatch: k8smanagersv1.MismatchSkip,
+			}
+
+			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
+			Expect(createResource(resource)).To(Succeed())
+
+			deployment.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscred",
+			}
+
+			Expect(createDeployment(deployment)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			// Get deployment and check node selector, it should not have been moved
+			actualDeployment := &appsv1.Deployment{}
+
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: deployment.ObjectMeta.Namespace,
+				Name:      deployment.ObjectMeta.Name,
+			}, actualDeployment)).To(Succeed())
+
+			Expect(actualDeployment.Spec.Template.Spec.NodeSelector).To(HaveKeyWithValue("pasx/node", "miscred"))
+
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+			Expect(actualResource.Status.Procedures[0].Workloads[0].Phase).To(Equal(k8smanagersv1.PhaseSkipped))
+		})
+
+		It("Test warn on mismatch records it on the workload status", func() {
+			procedure := k8smanagersv1.Procedure{
+				Type:      "deployment",
+				Namespace: "default",
+				Workloads: []string{deployment.Name},
+				Selector: k8smanagersv1.Selector{
+					Key:     "pasx/node",
+					Initial: "miscblue",
+					Target:  "miscgreen",
+				},
+				Timeout:    5,
+				OnMismatch: k8smanagersv1.MismatchWarn,
+			}
+
+			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
+			Expect(createResource(resource)).To(Succeed())
+
+			deployment.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscred",
+			}
+
+			Expect(createDeployment(deployment)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			// Get deployment and check node selector, it should have been moved anyway
+			actualDeployment := &appsv1.Deployment{}
+
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: deployment.ObjectMeta.Namespace,
+				Name:      deployment.ObjectMeta.Name,
+			}, actualDeployment)).To(Succeed())
+
+			Expect(actualDeployment.Spec.Template.Spec.NodeSelector).To(HaveKeyWithValue("pasx/node", "miscgreen"))
+
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+			Expect(actualResource.Status.Procedures[0].Workloads[0].Message).To(ContainSubstring("not on the initial node pool"))
+		})
+
 		It("Test selector on Deployment ", func() {
 			procedure := k8smanagersv1.Procedure{
 				Type:      "deployment",
@@ -142,38 +504,1079 @@ var _ = Describe("WorkloadManager Controller", func() {
 			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
 			Expect(createResource(resource)).To(Succeed())
 
-			nodeSelector := map[string]string{
+			nodeSelector := map[string]string{
+				"pasx/node": "miscblue",
+			}
+
+			deployment.Spec.Template.Spec.NodeSelector = nodeSelector
+
+			Expect(createDeployment(deployment)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			// Get deployment and check node selector, it should be updated with the target selector
+			actualDeployment := &appsv1.Deployment{}
+
+			_ = k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: deployment.ObjectMeta.Namespace,
+				Name:      deployment.ObjectMeta.Name,
+			}, actualDeployment)
+
+			actualNodeSelector := actualDeployment.Spec.Template.Spec.NodeSelector
+			Expect(actualNodeSelector).To(HaveKeyWithValue("pasx/node", "miscgreen"))
+		})
+
+		It("Test conflicting field manager is reported", func() {
+			forceConflicts := false
+			procedure := k8smanagersv1.Procedure{
+				Type:      "deployment",
+				Namespace: "default",
+				Workloads: []string{deployment.Name},
+				Selector: k8smanagersv1.Selector{
+					Key:     "pasx/node",
+					Initial: "miscblue",
+					Target:  "miscgreen",
+				},
+				Timeout:        5,
+				ForceConflicts: &forceConflicts,
+			}
+
+			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
+			Expect(createResource(resource)).To(Succeed())
+
+			deployment.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscblue",
+			}
+
+			Expect(createDeployment(deployment)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			// Get deployment and check node selector, it is owned by the test client and should be left alone
+			actualDeployment := &appsv1.Deployment{}
+
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: deployment.ObjectMeta.Namespace,
+				Name:      deployment.ObjectMeta.Name,
+			}, actualDeployment)).To(Succeed())
+
+			Expect(actualDeployment.Spec.Template.Spec.NodeSelector).To(HaveKeyWithValue("pasx/node", "miscblue"))
+
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+			Expect(actualResource.Status.Procedures[0].Workloads[0].Phase).To(Equal(k8smanagersv1.PhaseFailed))
+			Expect(actualResource.Status.Procedures[0].Workloads[0].LastError).To(ContainSubstring("forceConflicts"))
+			Expect(meta.IsStatusConditionTrue(actualResource.Status.Conditions, k8smanagersv1.ConditionDegraded)).To(BeTrue())
+
+			degraded := meta.FindStatusCondition(actualResource.Status.Conditions, k8smanagersv1.ConditionDegraded)
+			Expect(degraded.Reason).To(Equal("FieldConflict"))
+		})
+
+		It("Test conflicting fields are not taken over by default", func() {
+			procedure := k8smanagersv1.Procedure{
+				Type:      "deployment",
+				Namespace: "default",
+				Workloads: []string{deployment.Name},
+				Selector: k8smanagersv1.Selector{
+					Key:     "pasx/node",
+					Initial: "miscblue",
+					Target:  "miscgreen",
+				},
+				Timeout: 5,
+			}
+
+			// Created without createResource, which forces conflicts for the other tests
+			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
+			Expect(k8sClient.Create(ctx, resource)).To(Succeed())
+			Expect(resource.Spec.Procedures[0].ForceConflicts).NotTo(BeNil())
+			Expect(*resource.Spec.Procedures[0].ForceConflicts).To(BeFalse())
+
+			deployment.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscblue",
+			}
+			Expect(createDeployment(deployment)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			actualDeployment := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(deployment), actualDeployment)).To(Succeed())
+			Expect(actualDeployment.Spec.Template.Spec.NodeSelector).To(HaveKeyWithValue("pasx/node", "miscblue"))
+
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+			Expect(actualResource.Status.Procedures[0].Workloads[0].Phase).To(Equal(k8smanagersv1.PhaseFailed))
+			Expect(actualResource.Status.Procedures[0].Workloads[0].LastError).To(ContainSubstring("set forceConflicts: true to take ownership"))
+		})
+
+		It("Test selector removal on Deployment", func() {
+			procedure := k8smanagersv1.Procedure{
+				Type:      "deployment",
+				Namespace: "default",
+				Workloads: []string{deployment.Name},
+				Selector: k8smanagersv1.Selector{
+					Key:     "pasx/node",
+					Initial: "miscblue",
+					Remove:  true,
+				},
+				Timeout: 5,
+			}
+
+			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
+			Expect(createResource(resource)).To(Succeed())
+
+			deployment.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node":        "miscblue",
+				"kubernetes.io/os": "linux",
+			}
+
+			Expect(createDeployment(deployment)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			// Get deployment and check node selector, the key should be gone and the others kept
+			actualDeployment := &appsv1.Deployment{}
+
+			_ = k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: deployment.ObjectMeta.Namespace,
+				Name:      deployment.ObjectMeta.Name,
+			}, actualDeployment)
+
+			actualNodeSelector := actualDeployment.Spec.Template.Spec.NodeSelector
+			Expect(actualNodeSelector).NotTo(HaveKey("pasx/node"))
+			Expect(actualNodeSelector).To(HaveKeyWithValue("kubernetes.io/os", "linux"))
+		})
+
+		It("Test rollback on Deployment that is not ready", func() {
+			procedure := k8smanagersv1.Procedure{
+				Type:      "deployment",
+				Namespace: "default",
+				Workloads: []string{deployment.Name},
+				Selector: k8smanagersv1.Selector{
+					Key:     "pasx/node",
+					Initial: "miscblue",
+					Target:  "miscgreen",
+				},
+				Timeout:           5,
+				RollbackOnFailure: true,
+			}
+
+			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
+			Expect(createResource(resource)).To(Succeed())
+
+			deployment.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscblue",
+			}
+
+			Expect(createDeployment(deployment)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			// Get deployment and check node selector, the Deployment never becomes ready so it should be back on Initial
+			actualDeployment := &appsv1.Deployment{}
+
+			_ = k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: deployment.ObjectMeta.Namespace,
+				Name:      deployment.ObjectMeta.Name,
+			}, actualDeployment)
+
+			Expect(actualDeployment.Spec.Template.Spec.NodeSelector).To(HaveKeyWithValue("pasx/node", "miscblue"))
+
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+
+			wlStatus := actualResource.Status.Procedures[0].Workloads[0]
+			Expect(wlStatus.Phase).To(BeElementOf(k8smanagersv1.PhaseRolledBack, k8smanagersv1.PhaseFailed))
+			Expect(wlStatus.NodePool).To(Equal("miscblue"))
+			Expect(wlStatus.LastError).To(ContainSubstring("not ready"))
+			Expect(actualResource.Status.Phase).To(Equal(k8smanagersv1.PhaseFailed))
+		})
+
+		It("Test rollback on Deployment whose new ReplicaSet never becomes ready", func() {
+			procedure := k8smanagersv1.Procedure{
+				Type:      "deployment",
+				Namespace: "default",
+				Workloads: []string{deployment.Name},
+				Selector: k8smanagersv1.Selector{
+					Key:     "pasx/node",
+					Initial: "miscblue",
+					Target:  "miscgreen",
+				},
+				Timeout:           5,
+				RollbackOnFailure: true,
+			}
+
+			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
+			Expect(createResource(resource)).To(Succeed())
+
+			deployment.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscblue",
+			}
+			Expect(createDeployment(deployment)).To(Succeed())
+
+			// The pod of the old ReplicaSet is still ready on the initial pool
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-deployment-old",
+					Namespace: "default",
+					Labels:    map[string]string{"app": "test"},
+				},
+				Spec: deployment.Spec.Template.Spec,
+			}
+			Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+			DeferCleanup(func() { _ = k8sClient.Delete(ctx, pod) })
+			pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+			Expect(k8sClient.Status().Update(ctx, pod)).To(Succeed())
+
+			// The rollout has been observed, but the replica of the new ReplicaSet never becomes available
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(deployment), deployment)).To(Succeed())
+			deployment.Status = appsv1.DeploymentStatus{
+				ObservedGeneration: 10,
+				Replicas:           2,
+				UpdatedReplicas:    1,
+				ReadyReplicas:      1,
+				AvailableReplicas:  1,
+			}
+			Expect(k8sClient.Status().Update(ctx, deployment)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			actualDeployment := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(deployment), actualDeployment)).To(Succeed())
+			Expect(actualDeployment.Spec.Template.Spec.NodeSelector).To(HaveKeyWithValue("pasx/node", "miscblue"))
+
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+
+			wlStatus := actualResource.Status.Procedures[0].Workloads[0]
+			Expect(wlStatus.Phase).To(BeElementOf(k8smanagersv1.PhaseRolledBack, k8smanagersv1.PhaseFailed))
+			Expect(wlStatus.LastError).To(ContainSubstring("not ready"))
+			Expect(actualResource.Status.Phase).To(Equal(k8smanagersv1.PhaseFailed))
+		})
+
+		It("Test affinity on Statefulset", func() {
+
+			procedure := k8smanagersv1.Procedure{
+				Type:      "statefulset",
+				Namespace: "default",
+				Workloads: []string{statefulset.Name},
+				Affinity: k8smanagersv1.Affinity{
+					Key:     "agentpool",
+					Initial: "bluepool",
+					Target:  "greenpool",
+				},
+				Timeout: 5,
+			}
+
+			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
+			Expect(createResource(resource)).To(Succeed())
+
+			nodeAffinity := &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+					NodeSelectorTerms: []corev1.NodeSelectorTerm{
+						{
+							MatchExpressions: []corev1.NodeSelectorRequirement{
+								{
+									Key:      "agentpool",
+									Operator: corev1.NodeSelectorOpIn,
+									Values:   []string{"bluepool"},
+								},
+							},
+						},
+					},
+				},
+			}
+
+			affinity := &corev1.Affinity{
+				NodeAffinity: nodeAffinity,
+			}
+
+			statefulset.Spec.Template.Spec.Affinity = affinity
+
+			Expect(createStatefulset(statefulset)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			// Get statefulset and check affinity , it should be updated with the target affinity
+			actualStatefulset := &appsv1.StatefulSet{}
+
+			_ = k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: statefulset.ObjectMeta.Namespace,
+				Name:      statefulset.ObjectMeta.Name,
+			}, actualStatefulset)
+
+			actualAffinity := actualStatefulset.Spec.Template.Spec.Affinity.NodeAffinity
+			Expect(actualAffinity).NotTo(BeNil())
+			Expect(actualAffinity.RequiredDuringSchedulingIgnoredDuringExecution).NotTo(BeNil())
+			Expect(actualAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms).To(HaveLen(1))
+			Expect(actualAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions).To(HaveLen(1))
+			Expect(actualAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions[0].Key).To(Equal("agentpool"))
+			Expect(actualAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions[0].Operator).To(Equal(corev1.NodeSelectorOpIn))
+			Expect(actualAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions[0].Values).To(ContainElement("greenpool"))
+
+		})
+
+		It("Test selector on Statefulset ", func() {
+			procedure := k8smanagersv1.Procedure{
+				Type:      "statefulset",
+				Namespace: "default",
+				Workloads: []string{statefulset.Name},
+				Selector: k8smanagersv1.Selector{
+					Key:     "pasx/node",
+					Initial: "bluepool",
+					Target:  "greenpool",
+				},
+				Timeout: 5,
+			}
+
+			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
+			Expect(createResource(resource)).To(Succeed())
+
+			nodeSelector := map[string]string{
+				"pasx/node": "bluepool",
+			}
+
+			statefulset.Spec.Template.Spec.NodeSelector = nodeSelector
+
+			Expect(createStatefulset(statefulset)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			// Get deployment and check node selector, it should be updated with the target selector
+			actualStatefulset := &appsv1.StatefulSet{}
+
+			_ = k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: statefulset.ObjectMeta.Namespace,
+				Name:      statefulset.ObjectMeta.Name,
+			}, actualStatefulset)
+
+			actualNodeSelector := actualStatefulset.Spec.Template.Spec.NodeSelector
+			Expect(actualNodeSelector).To(HaveKeyWithValue("pasx/node", "greenpool"))
+		})
+
+		It("Test selector on DaemonSet", func() {
+			procedure := k8smanagersv1.Procedure{
+				Type:      "daemonset",
+				Namespace: "default",
+				Workloads: []string{daemonset.Name},
+				Selector: k8smanagersv1.Selector{
+					Key:     "pasx/node",
+					Initial: "miscblue",
+					Target:  "miscgreen",
+				},
+				Timeout: 5,
+			}
+
+			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
+			Expect(createResource(resource)).To(Succeed())
+
+			daemonset.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscblue",
+			}
+
+			Expect(createDaemonset(daemonset)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			// Get daemonset and check node selector, it should be updated with the target selector
+			actualDaemonset := &appsv1.DaemonSet{}
+
+			_ = k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: daemonset.ObjectMeta.Namespace,
+				Name:      daemonset.ObjectMeta.Name,
+			}, actualDaemonset)
+
+			actualNodeSelector := actualDaemonset.Spec.Template.Spec.NodeSelector
+			Expect(actualNodeSelector).To(HaveKeyWithValue("pasx/node", "miscgreen"))
+		})
+
+		It("Test affinity on suspended CronJob", func() {
+			procedure := k8smanagersv1.Procedure{
+				Type:      "cronjob",
+				Namespace: "default",
+				Workloads: []string{cronjob.Name},
+				Affinity: k8smanagersv1.Affinity{
+					Key:     "agentpool",
+					Initial: "bluepool",
+					Target:  "greenpool",
+				},
+				Timeout: 5,
+			}
+
+			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
+			Expect(createResource(resource)).To(Succeed())
+
+			suspend := true
+			cronjob.Spec.Suspend = &suspend
+			cronjob.Spec.JobTemplate.Spec.Template.Spec.Affinity = &corev1.Affinity{
+				NodeAffinity: &corev1.NodeAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+						NodeSelectorTerms: []corev1.NodeSelectorTerm{
+							{
+								MatchExpressions: []corev1.NodeSelectorRequirement{
+									{
+										Key:      "agentpool",
+										Operator: corev1.NodeSelectorOpIn,
+										Values:   []string{"bluepool"},
+									},
+								},
+							},
+						},
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(ctx, cronjob)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			// Get cronjob and check affinity, the job template should target the new pool
+			actualCronjob := &batchv1.CronJob{}
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(cronjob), actualCronjob)).To(Succeed())
+
+			nodeAffinity := actualCronjob.Spec.JobTemplate.Spec.Template.Spec.Affinity.NodeAffinity
+			expression := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions[0]
+			Expect(expression.Values).To(Equal([]string{"greenpool"}))
+
+			// A suspended CronJob is ready as soon as it has been updated
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+			Expect(actualResource.Status.Procedures[0].Workloads[0].Phase).To(Equal(k8smanagersv1.PhaseSucceeded))
+		})
+
+		It("Test running Job fails validation", func() {
+			procedure := k8smanagersv1.Procedure{
+				Type:      "job",
+				Namespace: "default",
+				Workloads: []string{job.Name},
+				Selector: k8smanagersv1.Selector{
+					Key:     "pasx/node",
+					Initial: "miscblue",
+					Target:  "miscgreen",
+				},
+				Timeout: 5,
+			}
+
+			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
+			Expect(createResource(resource)).To(Succeed())
+
+			job.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscblue",
+			}
+
+			Expect(k8sClient.Create(ctx, job)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+			Expect(actualResource.Status.Phase).To(Equal(k8smanagersv1.PhaseFailed))
+			Expect(actualResource.Status.Procedures[0].Workloads[0].LastError).To(ContainSubstring("suspended"))
+		})
+
+		It("Test workload selector on Deployment", func() {
+			procedure := k8smanagersv1.Procedure{
+				Type:      "deployment",
+				Namespace: "default",
+				WorkloadSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"tier": "web"},
+				},
+				Selector: k8smanagersv1.Selector{
+					Key:     "pasx/node",
+					Initial: "miscblue",
+					Target:  "miscgreen",
+				},
+				Timeout: 5,
+			}
+
+			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
+			Expect(createResource(resource)).To(Succeed())
+
+			second := newDeployment()
+			second.Name = "a-test-deployment"
+			for _, d := range []*appsv1.Deployment{deployment, second} {
+				d.Labels = map[string]string{"tier": "web"}
+				d.Spec.Template.Spec.NodeSelector = map[string]string{
+					"pasx/node": "miscblue",
+				}
+				Expect(createDeployment(d)).To(Succeed())
+			}
+			DeferCleanup(func() {
+				_ = k8sClient.Delete(ctx, second)
+			})
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			// Get resource and check status, both matches should be recorded in name order
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+
+			workloads := actualResource.Status.Procedures[0].Workloads
+			Expect(workloads).To(HaveLen(2))
+			Expect(workloads[0].Name).To(Equal(second.Name))
+			Expect(workloads[1].Name).To(Equal(deployment.Name))
+			Expect(workloads[0].Namespace).To(Equal("default"))
+
+			actualDeployment := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(second), actualDeployment)).To(Succeed())
+			Expect(actualDeployment.Spec.Template.Spec.NodeSelector).To(HaveKeyWithValue("pasx/node", "miscgreen"))
+		})
+
+		It("Test namespace selector with only named workloads fails validation", func() {
+			procedure := k8smanagersv1.Procedure{
+				Type:      "deployment",
+				Namespace: "default",
+				Workloads: []string{deployment.Name},
+				NamespaceSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"kubernetes.io/metadata.name": "default"},
+				},
+				Selector: k8smanagersv1.Selector{
+					Key:     "pasx/node",
+					Initial: "miscblue",
+					Target:  "miscgreen",
+				},
+				Timeout: 5,
+			}
+
+			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
+			Expect(createResource(resource)).To(Succeed())
+
+			deployment.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscblue",
+			}
+			Expect(createDeployment(deployment)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+			Expect(actualResource.Status.Phase).To(Equal(k8smanagersv1.PhaseFailed))
+
+			validated := meta.FindStatusCondition(actualResource.Status.Conditions, k8smanagersv1.ConditionValidated)
+			Expect(validated).NotTo(BeNil())
+			Expect(validated.Status).To(Equal(metav1.ConditionFalse))
+			Expect(validated.Message).To(ContainSubstring("namespaceSelector needs workloadSelector or discoverByInitial"))
+
+			actualDeployment := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(deployment), actualDeployment)).To(Succeed())
+			Expect(actualDeployment.Spec.Template.Spec.NodeSelector).To(HaveKeyWithValue("pasx/node", "miscblue"))
+		})
+
+		It("Test discover Deployments by initial selector", func() {
+			procedure := k8smanagersv1.Procedure{
+				Type:              "deployment",
+				Namespace:         "default",
+				DiscoverByInitial: true,
+				Selector: k8smanagersv1.Selector{
+					Key:     "pasx/node",
+					Initial: "miscblue",
+					Target:  "miscgreen",
+				},
+				Timeout: 5,
+			}
+
+			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
+			Expect(createResource(resource)).To(Succeed())
+
+			other := newDeployment()
+			other.Name = "other-test-deployment"
+			other.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "othernode",
+			}
+			deployment.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscblue",
+			}
+			Expect(createDeployment(deployment)).To(Succeed())
+			Expect(createDeployment(other)).To(Succeed())
+			DeferCleanup(func() {
+				_ = k8sClient.Delete(ctx, other)
+			})
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			// Only the Deployment on the initial selector should have been found and moved
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+
+			workloads := actualResource.Status.Procedures[0].Workloads
+			Expect(workloads).To(HaveLen(1))
+			Expect(workloads[0].Name).To(Equal(deployment.Name))
+
+			actualDeployment := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(other), actualDeployment)).To(Succeed())
+			Expect(actualDeployment.Spec.Template.Spec.NodeSelector).To(HaveKeyWithValue("pasx/node", "othernode"))
+		})
+
+		It("Test Deployments moved in parallel", func() {
+			second := newDeployment()
+			second.Name = "second-test-deployment"
+
+			procedure := k8smanagersv1.Procedure{
+				Type:      "deployment",
+				Namespace: "default",
+				Workloads: []string{deployment.Name, second.Name},
+				Selector: k8smanagersv1.Selector{
+					Key:     "pasx/node",
+					Initial: "miscblue",
+					Target:  "miscgreen",
+				},
+				Timeout:       5,
+				MaxConcurrent: 2,
+			}
+
+			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
+			Expect(createResource(resource)).To(Succeed())
+
+			for _, d := range []*appsv1.Deployment{deployment, second} {
+				d.Spec.Template.Spec.NodeSelector = map[string]string{
+					"pasx/node": "miscblue",
+				}
+				Expect(createDeployment(d)).To(Succeed())
+			}
+			DeferCleanup(func() {
+				_ = k8sClient.Delete(ctx, second)
+			})
+
+			start := time.Now()
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			// Both waits run at the same time, so the reconcile takes about one timeout rather than two
+			Expect(time.Since(start)).To(BeNumerically("<", 10*time.Second))
+
+			for _, d := range []*appsv1.Deployment{deployment, second} {
+				actualDeployment := &appsv1.Deployment{}
+				Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(d), actualDeployment)).To(Succeed())
+				Expect(actualDeployment.Spec.Template.Spec.NodeSelector).To(HaveKeyWithValue("pasx/node", "miscgreen"))
+			}
+
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+			for _, wlStatus := range actualResource.Status.Procedures[0].Workloads {
+				Expect(wlStatus.EndTime).NotTo(BeNil())
+			}
+		})
+
+		It("Test procedure dependency cycle fails validation", func() {
+			for _, names := range [][]string{{"db", "api"}, {"api", "db"}} {
+				resource.Spec.Procedures = append(resource.Spec.Procedures, k8smanagersv1.Procedure{
+					Name:      names[0],
+					DependsOn: []string{names[1]},
+					Type:      "deployment",
+					Namespace: "default",
+					Workloads: []string{deployment.Name},
+					Timeout:   5,
+				})
+			}
+			Expect(createResource(resource)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+			Expect(actualResource.Status.Phase).To(Equal(k8smanagersv1.PhaseFailed))
+
+			validated := meta.FindStatusCondition(actualResource.Status.Conditions, k8smanagersv1.ConditionValidated)
+			Expect(validated).NotTo(BeNil())
+			Expect(validated.Status).To(Equal(metav1.ConditionFalse))
+			Expect(validated.Message).To(ContainSubstring("depend on each other"))
+		})
+
+		It("Test procedures run in dependency order", func() {
+			api := newDeployment()
+			api.Name = "api-test-deployment"
+
+			// The api procedure is listed first but has to wait for the db procedure, a CronJob
+			// without runs that is ready as soon as it has been moved
+			resource.Spec.Procedures = append(resource.Spec.Procedures,
+				k8smanagersv1.Procedure{
+					Name:      "api",
+					DependsOn: []string{"db"},
+					Type:      "deployment",
+					Namespace: "default",
+					Workloads: []string{api.Name},
+					Selector: k8smanagersv1.Selector{
+						Key:     "pasx/node",
+						Initial: "miscblue",
+						Target:  "miscgreen",
+					},
+					Timeout: 5,
+				},
+				k8smanagersv1.Procedure{
+					Name:      "db",
+					Type:      "cronjob",
+					Namespace: "default",
+					Workloads: []string{cronjob.Name},
+					Selector: k8smanagersv1.Selector{
+						Key:     "pasx/node",
+						Initial: "miscblue",
+						Target:  "miscgreen",
+					},
+					Timeout: 5,
+				})
+			Expect(createResource(resource)).To(Succeed())
+
+			api.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscblue",
+			}
+			Expect(createDeployment(api)).To(Succeed())
+			DeferCleanup(func() {
+				_ = k8sClient.Delete(ctx, api)
+			})
+
+			cronjob.Spec.JobTemplate.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscblue",
+			}
+			Expect(k8sClient.Create(ctx, cronjob)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+
+			apiStatus := actualResource.Status.Procedures[0]
+			dbStatus := actualResource.Status.Procedures[1]
+			Expect(apiStatus.Name).To(Equal("api"))
+			Expect(dbStatus.Name).To(Equal("db"))
+			Expect(dbStatus.Phase).To(Equal(k8smanagersv1.PhaseSucceeded))
+			Expect(apiStatus.Message).To(BeEmpty())
+			Expect(apiStatus.Workloads[0].StartTime.Time).NotTo(BeTemporally("<", dbStatus.Workloads[0].EndTime.Time))
+		})
+
+		It("Test timed out dependency blocks its dependents", func() {
+			// The db Deployment never becomes ready, so the api procedure must not start
+			resource.Spec.Procedures = append(resource.Spec.Procedures,
+				k8smanagersv1.Procedure{
+					Name:      "db",
+					Type:      "deployment",
+					Namespace: "default",
+					Workloads: []string{deployment.Name},
+					Selector: k8smanagersv1.Selector{
+						Key:     "pasx/node",
+						Initial: "miscblue",
+						Target:  "miscgreen",
+					},
+					Timeout: 2,
+				},
+				k8smanagersv1.Procedure{
+					Name:      "api",
+					DependsOn: []string{"db"},
+					Type:      "cronjob",
+					Namespace: "default",
+					Workloads: []string{cronjob.Name},
+					Selector: k8smanagersv1.Selector{
+						Key:     "pasx/node",
+						Initial: "miscblue",
+						Target:  "miscgreen",
+					},
+					Timeout: 5,
+				})
+			Expect(createResource(resource)).To(Succeed())
+
+			deployment.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscblue",
+			}
+			Expect(createDeployment(deployment)).To(Succeed())
+
+			cronjob.Spec.JobTemplate.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscblue",
+			}
+			Expect(k8sClient.Create(ctx, cronjob)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+			Expect(actualResource.Status.Procedures[0].Phase).To(Equal(k8smanagersv1.PhaseTimedOut))
+			Expect(actualResource.Status.Procedures[1].Phase).To(Equal(k8smanagersv1.PhaseFailed))
+			Expect(actualResource.Status.Procedures[1].Message).To(ContainSubstring("db (TimedOut)"))
+			Expect(actualResource.Status.Phase).To(Equal(k8smanagersv1.PhaseFailed))
+
+			actualCronjob := &batchv1.CronJob{}
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(cronjob), actualCronjob)).To(Succeed())
+			Expect(actualCronjob.Spec.JobTemplate.Spec.Template.Spec.NodeSelector).To(HaveKeyWithValue("pasx/node", "miscblue"))
+		})
+
+		It("Test dependency phases release dependents", func() {
+			wlManager := &k8smanagersv1.WorkloadManager{Spec: k8smanagersv1.WorkloadManagerSpec{
+				Procedures: []k8smanagersv1.Procedure{{Name: "db"}, {Name: "api", DependsOn: []string{"db"}}},
+			}}
+			wlManager.Status.Procedures = make([]k8smanagersv1.ProcedureStatus, 2)
+			deps := []int{0}
+
+			for phase, released := range map[k8smanagersv1.ProcedurePhase]bool{
+				k8smanagersv1.PhaseSucceeded:  true,
+				k8smanagersv1.PhaseSkipped:    true,
+				k8smanagersv1.PhaseTimedOut:   false,
+				k8smanagersv1.PhaseRolledBack: false,
+				k8smanagersv1.PhaseFailed:     false,
+			} {
+				wlManager.Status.Procedures[0].Phase = phase
+				Expect(dependenciesDone(wlManager, deps)).To(Equal(released), string(phase))
+				Expect(blockedDependencies(wlManager, deps)).To(HaveLen(map[bool]int{true: 0, false: 1}[released]), string(phase))
+			}
+
+			// In list order a timed out procedure holds the next one back as well
+			wlManager.Spec.Procedures[1].DependsOn = nil
+			wlManager.Status.Procedures[0].Phase = k8smanagersv1.PhaseTimedOut
+			Expect(dependenciesDone(wlManager, deps)).To(BeFalse())
+			Expect(blockedDependencies(wlManager, deps)).To(HaveLen(1))
+		})
+
+		It("Test failed procedure only blocks the procedures depending on it", func() {
+			forceConflicts := false
+			selector := k8smanagersv1.Selector{
+				Key:     "pasx/node",
+				Initial: "miscblue",
+				Target:  "miscgreen",
+			}
+
+			// The db procedure fails on a field conflict, api and web depend on it in turn and
+			// batch depends on nothing
+			resource.Spec.Procedures = append(resource.Spec.Procedures,
+				k8smanagersv1.Procedure{
+					Name:           "db",
+					Type:           "deployment",
+					Namespace:      "default",
+					Workloads:      []string{deployment.Name},
+					Selector:       selector,
+					Timeout:        5,
+					ForceConflicts: &forceConflicts,
+				},
+				k8smanagersv1.Procedure{
+					Name:      "web",
+					DependsOn: []string{"api"},
+					Type:      "deployment",
+					Namespace: "default",
+					Workloads: []string{deployment.Name},
+					Selector:  selector,
+					Timeout:   5,
+				},
+				k8smanagersv1.Procedure{
+					Name:      "api",
+					DependsOn: []string{"db"},
+					Type:      "deployment",
+					Namespace: "default",
+					Workloads: []string{deployment.Name},
+					Selector:  selector,
+					Timeout:   5,
+				},
+				k8smanagersv1.Procedure{
+					Name:      "batch",
+					Type:      "cronjob",
+					Namespace: "default",
+					Workloads: []string{cronjob.Name},
+					Selector:  selector,
+					Timeout:   5,
+				})
+			Expect(createResource(resource)).To(Succeed())
+
+			deployment.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscblue",
+			}
+			Expect(createDeployment(deployment)).To(Succeed())
+
+			cronjob.Spec.JobTemplate.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscblue",
+			}
+			Expect(k8sClient.Create(ctx, cronjob)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+			Expect(actualResource.Status.Procedures[0].Phase).To(Equal(k8smanagersv1.PhaseFailed))
+			Expect(actualResource.Status.Procedures[1].Phase).To(Equal(k8smanagersv1.PhaseFailed))
+			Expect(actualResource.Status.Procedures[1].Message).To(ContainSubstring("api (Failed)"))
+			Expect(actualResource.Status.Procedures[2].Phase).To(Equal(k8smanagersv1.PhaseFailed))
+			Expect(actualResource.Status.Procedures[2].Message).To(ContainSubstring("db (Failed)"))
+			Expect(actualResource.Status.Procedures[3].Phase).To(Equal(k8smanagersv1.PhaseSucceeded))
+			Expect(actualResource.Status.Phase).To(Equal(k8smanagersv1.PhaseFailed))
+
+			actualCronjob := &batchv1.CronJob{}
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(cronjob), actualCronjob)).To(Succeed())
+			Expect(actualCronjob.Spec.JobTemplate.Spec.Template.Spec.NodeSelector).To(HaveKeyWithValue("pasx/node", "miscgreen"))
+		})
+
+		It("Test run resumes after a controller restart", func() {
+			procedure := k8smanagersv1.Procedure{
+				Type:      "deployment",
+				Namespace: "default",
+				Workloads: []string{deployment.Name},
+				Selector: k8smanagersv1.Selector{
+					Key:     "pasx/node",
+					Initial: "miscblue",
+					Target:  "miscgreen",
+				},
+				Timeout: 5,
+			}
+
+			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
+			Expect(createResource(resource)).To(Succeed())
+
+			deployment.Spec.Template.Spec.NodeSelector = map[string]string{
 				"pasx/node": "miscblue",
 			}
+			Expect(createDeployment(deployment)).To(Succeed())
 
-			deployment.Spec.Template.Spec.NodeSelector = nodeSelector
+			// Validate, then move the Deployment, with a new reconciler each time as after a restart
+			for i := 0; i < 2; i++ {
+				controllerReconciler := &WorkloadManagerReconciler{Client: k8sClient, Scheme: k8sClient.Scheme(), Config: cfg}
+				start := time.Now()
+				result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Requeue || result.RequeueAfter > 0).To(BeTrue())
+				Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+			}
 
-			Expect(createDeployment(deployment)).To(Succeed())
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+			Expect(actualResource.Status.Phase).To(Equal(k8smanagersv1.PhaseWaitingReady))
+			Expect(actualResource.Status.Procedures[0].Workloads[0].Phase).To(Equal(k8smanagersv1.PhaseWaitingReady))
 
 			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
 
-			// Get deployment and check node selector, it should be updated with the target selector
-			actualDeployment := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+			Expect(actualResource.Status.CompletedGeneration).To(Equal(actualResource.Generation))
+			Expect(actualResource.Status.Procedures[0].Workloads[0].Phase).To(BeElementOf(k8smanagersv1.PhaseSucceeded, k8smanagersv1.PhaseTimedOut))
+		})
 
-			_ = k8sClient.Get(ctx, client.ObjectKey{
-				Namespace: deployment.ObjectMeta.Namespace,
-				Name:      deployment.ObjectMeta.Name,
-			}, actualDeployment)
+		It("Test resumed run reads its status past a stale cache", func() {
+			procedure := k8smanagersv1.Procedure{
+				Type:      "deployment",
+				Namespace: "default",
+				Workloads: []string{deployment.Name},
+				Selector: k8smanagersv1.Selector{
+					Key:     "pasx/node",
+					Initial: "miscblue",
+					Target:  "miscgreen",
+				},
+				Timeout: 60,
+			}
 
-			actualNodeSelector := actualDeployment.Spec.Template.Spec.NodeSelector
-			Expect(actualNodeSelector).To(HaveKeyWithValue("pasx/node", "miscgreen"))
+			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
+			Expect(createResource(resource)).To(Succeed())
+
+			deployment.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscblue",
+			}
+			Expect(createDeployment(deployment)).To(Succeed())
+
+			controllerReconciler := &WorkloadManagerReconciler{Client: k8sClient, Scheme: k8sClient.Scheme(), Config: cfg}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			// The cache still holds the status from before the Deployment was moved
+			validated := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, validated)).To(Succeed())
+			Expect(validated.Status.Procedures[0].Workloads[0].Phase).To(Equal(k8smanagersv1.PhasePending))
+
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			controllerReconciler = &WorkloadManagerReconciler{
+				Client:    staleClient{Client: k8sClient, wlManager: validated},
+				Scheme:    k8sClient.Scheme(),
+				Config:    cfg,
+				APIReader: k8sClient,
+			}
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			// The Deployment is on target but not ready, it must not be reported as moved
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+			Expect(actualResource.Status.Procedures[0].Workloads[0].Phase).To(Equal(k8smanagersv1.PhaseWaitingReady))
 		})
 
-		It("Test affinity on Statefulset", func() {
+		It("Test watched workloads are read from informers limited to them", func() {
+			deployment := newDeployment()
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "test-deployment-abcde",
+				Labels:    map[string]string{"app": "test"},
+			}}
+			otherPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "other-abcde",
+				Labels:    map[string]string{"app": "other"},
+			}}
+			clientset := fake.NewClientset(deployment, pod, otherPod)
+
+			var mu sync.Mutex
+			restrictions := map[string]k8stesting.ListRestrictions{}
+			clientset.PrependReactor("list", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				Expect(action.GetNamespace()).To(Equal("default"))
+				restrictions[action.GetResource().Resource] = action.(k8stesting.ListAction).GetListRestrictions()
+				return false, nil, nil
+			})
+
+			events := make(chan event.GenericEvent, 16)
+			watcher := newWorkloadWatcher(clientset, events)
+
+			wlManager := newResource()
+			wlManager.Status.Procedures = []k8smanagersv1.ProcedureStatus{{
+				Type: k8smanagersv1.Deployment,
+				Workloads: []k8smanagersv1.WorkloadStatus{
+					{Name: deployment.Name, Namespace: "default", Phase: k8smanagersv1.PhaseWaitingReady},
+				},
+			}}
+			watcher.setWatched(wlManager)
+			watcher.watchWorkload(deployment, k8smanagersv1.Deployment)
+
+			Eventually(func() monitoring.Reader {
+				return watcher.reader(k8smanagersv1.Deployment, "default", deployment.Name)
+			}).ShouldNot(BeNil())
+			Eventually(events).Should(Receive())
+
+			mu.Lock()
+			Expect(restrictions["deployments"].Fields.String()).To(Equal("metadata.name=test-deployment"))
+			Expect(restrictions["pods"].Labels.String()).To(Equal("app=test"))
+			mu.Unlock()
 
+			reader := watcher.reader(k8smanagersv1.Deployment, "default", deployment.Name)
+			pods, err := reader.ListPods(ctx, "default", "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pods).To(HaveLen(1))
+			Expect(pods[0].Name).To(Equal(pod.Name))
+			_, err = reader.GetStatefulSet(ctx, "default", deployment.Name)
+			Expect(err).To(HaveOccurred())
+
+			// The informers stop with the last WorkloadManager waiting on the workload
+			watcher.release(types.NamespacedName{Namespace: wlManager.Namespace, Name: wlManager.Name})
+			Expect(watcher.reader(k8smanagersv1.Deployment, "default", deployment.Name)).To(BeNil())
+		})
+
+		It("Test target cluster clients are dropped with their last WorkloadManager", func() {
+			controllerReconciler := &WorkloadManagerReconciler{Client: k8sClient, Scheme: k8sClient.Scheme(), Config: cfg}
+
+			blue := clusterKey{SubscriptionID: "sub", ResourceGroup: "rg", ClusterName: "blue"}
+			green := clusterKey{SubscriptionID: "sub", ResourceGroup: "rg", ClusterName: "green"}
+			first := types.NamespacedName{Namespace: "default", Name: "first"}
+			second := types.NamespacedName{Namespace: "default", Name: "second"}
+
+			controllerReconciler.clusters = map[clusterKey]*targetCluster{
+				blue:  {expiresAt: time.Now().Add(time.Hour), owners: map[types.NamespacedName]struct{}{first: {}, second: {}}},
+				green: {expiresAt: time.Now().Add(time.Hour), owners: map[types.NamespacedName]struct{}{second: {}}},
+			}
+
+			controllerReconciler.releaseCluster(second)
+			Expect(controllerReconciler.clusters).To(HaveKey(blue))
+			Expect(controllerReconciler.clusters).NotTo(HaveKey(green))
+
+			controllerReconciler.releaseCluster(first)
+			Expect(controllerReconciler.clusters).To(BeEmpty())
+		})
+
+		It("Test target cluster clients are dropped once the run is over", func() {
 			procedure := k8smanagersv1.Procedure{
-				Type:      "statefulset",
+				Type:      "deployment",
 				Namespace: "default",
-				Workloads: []string{statefulset.Name},
-				Affinity: k8smanagersv1.Affinity{
-					Key:     "agentpool",
-					Initial: "bluepool",
-					Target:  "greenpool",
+				Workloads: []string{deployment.Name},
+				Selector: k8smanagersv1.Selector{
+					Key:     "pasx/node",
+					Initial: "miscblue",
+					Target:  "miscgreen",
 				},
 				Timeout: 5,
 			}
@@ -181,60 +1584,374 @@ var _ = Describe("WorkloadManager Controller", func() {
 			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
 			Expect(createResource(resource)).To(Succeed())
 
-			nodeAffinity := &corev1.NodeAffinity{
-				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
-					NodeSelectorTerms: []corev1.NodeSelectorTerm{
-						{
-							MatchExpressions: []corev1.NodeSelectorRequirement{
-								{
-									Key:      "agentpool",
-									Operator: corev1.NodeSelectorOpIn,
-									Values:   []string{"bluepool"},
-								},
-							},
-						},
-					},
+			deployment.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscgreen",
+			}
+			Expect(createDeployment(deployment)).To(Succeed())
+
+			controllerReconciler := &WorkloadManagerReconciler{Client: k8sClient, Scheme: k8sClient.Scheme(), Config: cfg}
+			for i := 0; i < 2; i++ {
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+			Expect(actualResource.Status.Phase).To(Equal(k8smanagersv1.PhaseSucceeded))
+			Expect(controllerReconciler.clusters).To(BeEmpty())
+		})
+
+		It("Test Deployment moved with a kubeconfig from a Secret", func() {
+			secret := newKubeconfigSecret()
+			Expect(k8sClient.Create(ctx, secret)).To(Succeed())
+			DeferCleanup(func() {
+				_ = k8sClient.Delete(ctx, secret)
+			})
+
+			resource.Spec.SPNLoginType = k8smanagersv1.KubeconfigSecret
+			resource.Spec.KubeconfigSecretRef = &k8smanagersv1.SecretKeyReference{Name: secret.Name}
+			resource.Spec.Procedures = append(resource.Spec.Procedures, k8smanagersv1.Procedure{
+				Type:      "deployment",
+				Namespace: "default",
+				Workloads: []string{deployment.Name},
+				Selector: k8smanagersv1.Selector{
+					Key:     "pasx/node",
+					Initial: "miscblue",
+					Target:  "miscgreen",
 				},
+				Timeout: 5,
+			})
+			Expect(createResource(resource)).To(Succeed())
+
+			deployment.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscblue",
 			}
+			Expect(createDeployment(deployment)).To(Succeed())
 
-			affinity := &corev1.Affinity{
-				NodeAffinity: nodeAffinity,
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			actualDeployment := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(deployment), actualDeployment)).To(Succeed())
+			Expect(actualDeployment.Spec.Template.Spec.NodeSelector).To(HaveKeyWithValue("pasx/node", "miscgreen"))
+		})
+
+		It("Test logins to a target cluster are shared and do not block other WorkloadManagers", func() {
+			secret := newKubeconfigSecret()
+			Expect(k8sClient.Create(ctx, secret)).To(Succeed())
+			DeferCleanup(func() {
+				_ = k8sClient.Delete(ctx, secret)
+			})
+
+			blocking := blockingClient{Client: k8sClient, started: make(chan struct{}, 1), release: make(chan struct{})}
+			controllerReconciler := &WorkloadManagerReconciler{Client: blocking, Scheme: k8sClient.Scheme(), Config: cfg}
+
+			clusters := make(chan *targetCluster, 3)
+			for i := 0; i < 3; i++ {
+				wlManager := newResource()
+				wlManager.Name = fmt.Sprintf("login-%d", i)
+				wlManager.Spec.SPNLoginType = k8smanagersv1.KubeconfigSecret
+				wlManager.Spec.KubeconfigSecretRef = &k8smanagersv1.SecretKeyReference{Name: secret.Name}
+				go func() {
+					defer GinkgoRecover()
+					cluster, err := controllerReconciler.targetCluster(ctx, wlManager)
+					Expect(err).NotTo(HaveOccurred())
+					clusters <- cluster
+				}()
 			}
+			Eventually(blocking.started).Should(Receive())
 
-			statefulset.Spec.Template.Spec.Affinity = affinity
+			// The clients of other clusters can be used while the login is in progress
+			released := make(chan struct{})
+			go func() {
+				controllerReconciler.releaseCluster(types.NamespacedName{Namespace: "default", Name: "other"})
+				close(released)
+			}()
+			Eventually(released).Should(BeClosed())
 
-			Expect(createStatefulset(statefulset)).To(Succeed())
+			close(blocking.release)
+			first := <-clusters
+			Expect(<-clusters).To(BeIdenticalTo(first))
+			Expect(<-clusters).To(BeIdenticalTo(first))
+			Expect(controllerReconciler.clusters).To(HaveLen(1))
+			Expect(first.owners).To(HaveLen(3))
+		})
+
+		It("Test kubeconfig Secret is watched instead of read at every step", func() {
+			secret := newKubeconfigSecret()
+			Expect(k8sClient.Create(ctx, secret)).To(Succeed())
+			DeferCleanup(func() {
+				_ = k8sClient.Delete(ctx, secret)
+			})
+
+			resource.Spec.SPNLoginType = k8smanagersv1.KubeconfigSecret
+			resource.Spec.KubeconfigSecretRef = &k8smanagersv1.SecretKeyReference{Name: secret.Name}
+			Expect(createResource(resource)).To(Succeed())
+
+			metadataClient, err := metadata.NewForConfig(cfg)
+			Expect(err).NotTo(HaveOccurred())
+			events := make(chan event.GenericEvent, 10)
+			controllerReconciler := &WorkloadManagerReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+				events: events,
+			}
+			controllerReconciler.secrets = newSecretWatcher(metadataClient, events)
+			DeferCleanup(func() { controllerReconciler.releaseCluster(typeNamespacedName) })
+
+			// Once the watch has synced the version comes from it
+			Eventually(func() bool {
+				_, ok := controllerReconciler.secrets.version(typeNamespacedName, client.ObjectKeyFromObject(secret))
+				return ok
+			}, 10*time.Second, 100*time.Millisecond).Should(BeTrue())
+			version, err := controllerReconciler.credentialVersion(ctx, resource)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(version).To(Equal(secret.ResourceVersion))
+
+			// A rotated Secret asks for the WorkloadManager to be reconciled and changes the version
+			secret.Data["rotated"] = []byte("true")
+			Expect(k8sClient.Update(ctx, secret)).To(Succeed())
+
+			var rotated event.GenericEvent
+			Eventually(events, 10*time.Second).Should(Receive(&rotated))
+			Expect(client.ObjectKeyFromObject(rotated.Object)).To(Equal(typeNamespacedName))
+			Eventually(func() (string, error) {
+				return controllerReconciler.credentialVersion(ctx, resource)
+			}, 10*time.Second, 100*time.Millisecond).Should(Equal(secret.ResourceVersion))
+
+			// A WorkloadManager that is done with the Secret stops watching it
+			controllerReconciler.releaseCluster(typeNamespacedName)
+			Expect(controllerReconciler.secrets.informers).To(BeEmpty())
+		})
+
+		It("Test login to a target cluster outlives the reconcile that started it", func() {
+			secret := newKubeconfigSecret()
+			Expect(k8sClient.Create(ctx, secret)).To(Succeed())
+			DeferCleanup(func() {
+				_ = k8sClient.Delete(ctx, secret)
+			})
+
+			// The reconcile is cancelled as the login reads the Secret, after the credentials were checked
+			reconcileCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			reads := int32(2)
+			controllerReconciler := &WorkloadManagerReconciler{
+				Client: cancellingClient{Client: k8sClient, reads: &reads, cancel: cancel},
+				Scheme: k8sClient.Scheme(),
+			}
+
+			wlManager := newResource()
+			wlManager.Spec.SPNLoginType = k8smanagersv1.KubeconfigSecret
+			wlManager.Spec.KubeconfigSecretRef = &k8smanagersv1.SecretKeyReference{Name: secret.Name}
+
+			cluster, err := controllerReconciler.targetCluster(reconcileCtx, wlManager)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reconcileCtx.Err()).To(HaveOccurred())
+			Expect(controllerReconciler.clusters).To(ContainElement(BeIdenticalTo(cluster)))
+		})
+
+		It("Test replaced target cluster clients keep their WorkloadManagers and watched workloads", func() {
+			events := make(chan event.GenericEvent, 10)
+			controllerReconciler := &WorkloadManagerReconciler{Client: k8sClient, Scheme: k8sClient.Scheme(), Config: cfg, events: events}
+
+			wlManager := newResource()
+			other := types.NamespacedName{Namespace: "default", Name: "other"}
+			watchedKey := workloadKey(k8smanagersv1.Deployment, "default", "other-deployment")
+
+			// The clients of the cluster have expired while another WorkloadManager waits on a workload
+			stale := &targetCluster{
+				expiresAt: time.Now().Add(-time.Minute),
+				owners:    map[types.NamespacedName]struct{}{other: {}},
+				watcher:   newWorkloadWatcher(fake.NewClientset(), events),
+			}
+			stale.watcher.watchers[watchedKey] = map[types.NamespacedName]struct{}{other: {}}
+			controllerReconciler.clusters = map[clusterKey]*targetCluster{clusterKeyOf(wlManager): stale}
+
+			cluster, err := controllerReconciler.targetCluster(ctx, wlManager)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cluster).NotTo(BeIdenticalTo(stale))
+			Expect(controllerReconciler.clusters[clusterKeyOf(wlManager)]).To(BeIdenticalTo(cluster))
+			Expect(cluster.owners).To(HaveKey(other))
+			Expect(cluster.owners).To(HaveKey(client.ObjectKeyFromObject(wlManager)))
+			Expect(cluster.watcher.watchers).To(HaveKeyWithValue(watchedKey, HaveKey(other)))
+
+			// The other WorkloadManager is reconciled to watch its workload on the new clients
+			var adopted event.GenericEvent
+			Eventually(events).Should(Receive(&adopted))
+			Expect(client.ObjectKeyFromObject(adopted.Object)).To(Equal(other))
+
+			controllerReconciler.releaseCluster(other)
+			controllerReconciler.releaseCluster(client.ObjectKeyFromObject(wlManager))
+			Expect(controllerReconciler.clusters).To(BeEmpty())
+		})
+
+		It("Test missing kubeconfig Secret fails validation", func() {
+			resource.Spec.SPNLoginType = k8smanagersv1.KubeconfigSecret
+			resource.Spec.KubeconfigSecretRef = &k8smanagersv1.SecretKeyReference{Name: "missing-kubeconfig"}
+			Expect(createResource(resource)).To(Succeed())
 
 			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
 
-			// Get statefulset and check affinity , it should be updated with the target affinity
-			actualStatefulset := &appsv1.StatefulSet{}
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+			Expect(actualResource.Status.Phase).To(Equal(k8smanagersv1.PhaseFailed))
 
-			_ = k8sClient.Get(ctx, client.ObjectKey{
-				Namespace: statefulset.ObjectMeta.Namespace,
-				Name:      statefulset.ObjectMeta.Name,
-			}, actualStatefulset)
+			validated := meta.FindStatusCondition(actualResource.Status.Conditions, k8smanagersv1.ConditionValidated)
+			Expect(validated).NotTo(BeNil())
+			Expect(validated.Message).To(ContainSubstring("default/missing-kubeconfig"))
+		})
 
-			actualAffinity := actualStatefulset.Spec.Template.Spec.Affinity.NodeAffinity
-			Expect(actualAffinity).NotTo(BeNil())
-			Expect(actualAffinity.RequiredDuringSchedulingIgnoredDuringExecution).NotTo(BeNil())
-			Expect(actualAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms).To(HaveLen(1))
-			Expect(actualAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions).To(HaveLen(1))
-			Expect(actualAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions[0].Key).To(Equal("agentpool"))
-			Expect(actualAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions[0].Operator).To(Equal(corev1.NodeSelectorOpIn))
-			Expect(actualAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions[0].Values).To(ContainElement("greenpool"))
+		It("Test kubeconfig Secret in another namespace fails validation", func() {
+			resource.Spec.SPNLoginType = k8smanagersv1.KubeconfigSecret
+			resource.Spec.KubeconfigSecretRef = &k8smanagersv1.SecretKeyReference{Name: "test-kubeconfig", Namespace: "kube-system"}
+			Expect(createResource(resource)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+			Expect(actualResource.Status.Phase).To(Equal(k8smanagersv1.PhaseFailed))
 
+			validated := meta.FindStatusCondition(actualResource.Status.Conditions, k8smanagersv1.ConditionValidated)
+			Expect(validated).NotTo(BeNil())
+			Expect(validated.Message).To(ContainSubstring("kubeconfigSecretRef.namespace must be the namespace of the WorkloadManager"))
 		})
 
-		It("Test selector on Statefulset ", func() {
+		It("Test missing certificate Secret fails validation", func() {
+			resource.Spec.SPNLoginType = k8smanagersv1.AzureIdentity
+			resource.Spec.SubscriptionID = "00000000-0000-0000-0000-000000000000"
+			resource.Spec.ResourceGroup = "rg"
+			resource.Spec.ClusterName = "aks"
+			resource.Spec.AzureIdentity = &k8smanagersv1.AzureIdentityConfig{
+				Method:               k8smanagersv1.ClientCertificate,
+				ClientID:             "client",
+				TenantID:             "tenant",
+				CertificateSecretRef: &k8smanagersv1.SecretReference{Name: "missing-certificate"},
+			}
+			Expect(createResource(resource)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+			Expect(actualResource.Status.Phase).To(Equal(k8smanagersv1.PhaseFailed))
+
+			validated := meta.FindStatusCondition(actualResource.Status.Conditions, k8smanagersv1.ConditionValidated)
+			Expect(validated).NotTo(BeNil())
+			Expect(validated.Message).To(ContainSubstring("default/missing-certificate"))
+		})
+
+		It("Test certificate Secret in another namespace fails validation", func() {
+			resource.Spec.SPNLoginType = k8smanagersv1.AzureIdentity
+			resource.Spec.SubscriptionID = "00000000-0000-0000-0000-000000000000"
+			resource.Spec.ResourceGroup = "rg"
+			resource.Spec.ClusterName = "aks"
+			resource.Spec.AzureIdentity = &k8smanagersv1.AzureIdentityConfig{
+				Method:               k8smanagersv1.ClientCertificate,
+				ClientID:             "client",
+				TenantID:             "tenant",
+				CertificateSecretRef: &k8smanagersv1.SecretReference{Name: "certificate", Namespace: "kube-system"},
+			}
+			Expect(createResource(resource)).To(Succeed())
+
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+			Expect(actualResource.Status.Phase).To(Equal(k8smanagersv1.PhaseFailed))
+
+			validated := meta.FindStatusCondition(actualResource.Status.Conditions, k8smanagersv1.ConditionValidated)
+			Expect(validated).NotTo(BeNil())
+			Expect(validated.Message).To(ContainSubstring("azureIdentity.certificateSecretRef.namespace must be the namespace of the WorkloadManager"))
+		})
+
+		It("Test Entra ID clusters are reached with tokens from the identity", func() {
+			kubeconfig := newKubeconfigSecret().Data["kubeconfig"]
+
+			// A cluster with local accounts keeps the credentials of its kubeconfig
+			config, err := tokenConfig(kubeconfig, fakeCredential{token: "unused"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.CertData).To(Equal(cfg.CertData))
+			Expect(config.WrapTransport).To(BeNil())
+
+			apiConfig, err := clientcmd.Load(kubeconfig)
+			Expect(err).NotTo(HaveOccurred())
+			apiConfig.AuthInfos["envtest"] = &clientcmdapi.AuthInfo{
+				Exec: &clientcmdapi.ExecConfig{Command: "kubelogin", APIVersion: "client.authentication.k8s.io/v1beta1"},
+			}
+			kubeconfig, err = clientcmd.Write(*apiConfig)
+			Expect(err).NotTo(HaveOccurred())
+
+			config, err = tokenConfig(kubeconfig, fakeCredential{token: "entra-token"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Host).To(Equal(cfg.Host))
+			Expect(config.CAData).To(Equal(cfg.CAData))
+			Expect(config.ExecProvider).To(BeNil())
+
+			var authorization string
+			rt := config.WrapTransport(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				authorization = req.Header.Get("Authorization")
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+			}))
+			req, err := http.NewRequest(http.MethodGet, cfg.Host, nil)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = rt.RoundTrip(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(authorization).To(Equal("Bearer entra-token"))
+		})
+
+		It("Test listed Entra ID user credentials are kept in memory", func() {
+			home := GinkgoT().TempDir()
+			GinkgoT().Setenv("HOME", home)
+
+			// Clusters using Entra ID list a kubeconfig running kubelogin
+			apiConfig := clientcmdapi.NewConfig()
+			apiConfig.Clusters["aks"] = &clientcmdapi.Cluster{Server: "https://aks.example.com:443"}
+			apiConfig.AuthInfos["clusterUser"] = &clientcmdapi.AuthInfo{
+				Exec: &clientcmdapi.ExecConfig{Command: "kubelogin", APIVersion: "client.authentication.k8s.io/v1beta1"},
+			}
+			apiConfig.Contexts["aks"] = &clientcmdapi.Context{Cluster: "aks", AuthInfo: "clusterUser"}
+			apiConfig.CurrentContext = "aks"
+			kubeconfig, err := clientcmd.Write(*apiConfig)
+			Expect(err).NotTo(HaveOccurred())
+
+			// Azure Resource Manager answers with the kubeconfig
+			management := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				Expect(req.URL.Path).To(HaveSuffix("/managedClusters/aks/listClusterUserCredential"))
+				body := fmt.Sprintf(`{"kubeconfigs":[{"name":"clusterUser","value":%q}]}`, base64.StdEncoding.EncodeToString(kubeconfig))
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"application/json"}},
+					Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+			})
+			aksClient, err := armcontainerservice.NewManagedClustersClient("sub", fakeCredential{token: "arm-token"},
+				&arm.ClientOptions{ClientOptions: policy.ClientOptions{Transport: &http.Client{Transport: management}}})
+			Expect(err).NotTo(HaveOccurred())
+
+			resource.Spec.SPNLoginType = k8smanagersv1.ListClusterUserCredentials
+			resource.Spec.SubscriptionID = "sub"
+			resource.Spec.ResourceGroup = "rg"
+			resource.Spec.ClusterName = "aks"
+
+			controllerReconciler := &WorkloadManagerReconciler{Client: k8sClient, Scheme: k8sClient.Scheme(), Config: cfg}
+			config, err := controllerReconciler.getClientSet(context.WithValue(ctx, "ManagedClusterClient", aksClient), resource)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Host).To(Equal("https://aks.example.com:443"))
+			Expect(config.ExecProvider).To(BeNil())
+			Expect(config.WrapTransport).NotTo(BeNil())
+
+			// No kubeconfig was written
+			entries, err := os.ReadDir(home)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(BeEmpty())
+		})
+
+		It("Test cancelled reconcile leaves the run to be resumed", func() {
 			procedure := k8smanagersv1.Procedure{
-				Type:      "statefulset",
+				Type:      "deployment",
 				Namespace: "default",
-				Workloads: []string{statefulset.Name},
+				Workloads: []string{deployment.Name},
 				Selector: k8smanagersv1.Selector{
 					Key:     "pasx/node",
-					Initial: "bluepool",
-					Target:  "greenpool",
+					Initial: "miscblue",
+					Target:  "miscgreen",
 				},
 				Timeout: 5,
 			}
@@ -242,26 +1959,30 @@ var _ = Describe("WorkloadManager Controller", func() {
 			resource.Spec.Procedures = append(resource.Spec.Procedures, procedure)
 			Expect(createResource(resource)).To(Succeed())
 
-			nodeSelector := map[string]string{
-				"pasx/node": "bluepool",
+			deployment.Spec.Template.Spec.NodeSelector = map[string]string{
+				"pasx/node": "miscblue",
 			}
+			Expect(createDeployment(deployment)).To(Succeed())
 
-			statefulset.Spec.Template.Spec.NodeSelector = nodeSelector
-
-			Expect(createStatefulset(statefulset)).To(Succeed())
+			controllerReconciler := &WorkloadManagerReconciler{Client: k8sClient, Scheme: k8sClient.Scheme(), Config: cfg}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
 
-			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
+			// Shut down before the first step
+			cancelled, cancel := context.WithCancel(ctx)
+			cancel()
+			_, err = controllerReconciler.Reconcile(cancelled, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).To(MatchError(context.Canceled))
 
-			// Get deployment and check node selector, it should be updated with the target selector
-			actualStatefulset := &appsv1.StatefulSet{}
+			actualResource := &k8smanagersv1.WorkloadManager{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, actualResource)).To(Succeed())
+			Expect(actualResource.Status.Phase).NotTo(Equal(k8smanagersv1.PhaseFailed))
 
-			_ = k8sClient.Get(ctx, client.ObjectKey{
-				Namespace: statefulset.ObjectMeta.Namespace,
-				Name:      statefulset.ObjectMeta.Name,
-			}, actualStatefulset)
+			Expect(triggerReconcile(ctx, k8sClient, typeNamespacedName)).To(Succeed())
 
-			actualNodeSelector := actualStatefulset.Spec.Template.Spec.NodeSelector
-			Expect(actualNodeSelector).To(HaveKeyWithValue("pasx/node", "greenpool"))
+			actualDeployment := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(deployment), actualDeployment)).To(Succeed())
+			Expect(actualDeployment.Spec.Template.Spec.NodeSelector).To(HaveKeyWithValue("pasx/node", "miscgreen"))
 		})
 
 	})
@@ -271,16 +1992,32 @@ func triggerReconcile(ctx context.Context, k8sClient client.Client, typeNamespac
 	controllerReconciler := &WorkloadManagerReconciler{
 		Client: k8sClient,
 		Scheme: k8sClient.Scheme(),
+		Config: cfg,
 	}
 
-	_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
-		NamespacedName: typeNamespacedName,
-	})
+	// Each reconcile runs one step, keep going until the controller stops asking to be requeued
+	for i := 0; i < 100; i++ {
+		result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+			NamespacedName: typeNamespacedName,
+		})
+		if err != nil || (!result.Requeue && result.RequeueAfter == 0) {
+			return err
+		}
+		time.Sleep(result.RequeueAfter)
+	}
 
-	return err
+	return fmt.Errorf("%s was still being reconciled after 100 steps", typeNamespacedName)
 }
 
+// createResource creates the WorkloadManager. The workloads are created by the test client, which
+// owns their scheduling fields, so procedures take them over unless a test sets ForceConflicts itself.
 func createResource(resource *k8smanagersv1.WorkloadManager) error {
+	force := true
+	for i := range resource.Spec.Procedures {
+		if resource.Spec.Procedures[i].ForceConflicts == nil {
+			resource.Spec.Procedures[i].ForceConflicts = &force
+		}
+	}
 	return k8sClient.Create(ctx, resource)
 }
 
@@ -292,4 +2029,8 @@ func createStatefulset(statefuleset *appsv1.StatefulSet) error {
 	return k8sClient.Create(ctx, statefuleset)
 }
 
+func createDaemonset(daemonset *appsv1.DaemonSet) error {
+	return k8sClient.Create(ctx, daemonset)
+}
+
 func int32Ptr(i int32) *int32 { return &i }